@@ -33,7 +33,8 @@ class AutoTuner:
             elif stat['stat_name'] == self._options.tune_stat_compare_name:
                 compare_stat = stat
         
-        diff_perc = target_stat['stat_rate_per_second'] / compare_stat['stat_rate_per_second']
+        rate_field = self._options.tune_rate_field
+        diff_perc = target_stat[rate_field] / compare_stat[rate_field]
         
         info = {}
                 
@@ -42,6 +42,9 @@ def main():
     parser.add_argument('--tune-stat-compare-name','-c', dest='tune_stat_compare_name', default=None, required=True,
                         help='Stat used for comparison to determine if goal is being reached.')
 
+    parser.add_argument('--tune-rate-field','-rf', dest='tune_rate_field', default='stat_rate_ewma_10s',
+                        help='Rate field to compare. stat_rate_per_second is the raw rate over the last dhammer stats tick. The stat_rate_ewma_* fields are smoothed.')
+
     parser.add_argument('--tune-compare-min-percentage','-cp', dest='tune_compare_min_percentage', default=0.95,
                         help='The maximum percentage difference between the tuning stat and the comparison stat.')
 
@@ -2,16 +2,25 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/filter"
 	"github.com/ipchama/dhammer/hammer"
 	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/namespace"
+	"github.com/ipchama/dhammer/profile"
 	"github.com/ipchama/dhammer/socketeer"
+	"github.com/ipchama/dhammer/transaction"
+	"github.com/ipchama/dhammer/vlan"
 	"github.com/spf13/cobra"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,12 +35,29 @@ func prepareCmd(cmd *cobra.Command) *cobra.Command {
 	cmd.Flags().Bool("decline", false, "Decline offers.")
 
 	cmd.Flags().Int("rps", 0, "Max number of packets per second. 0 == unlimited.")
+	cmd.Flags().Int("burst", 0, "Max number of packets sent back to back when catching up to --rps. 0 == enough to make up for late timers.")
 	cmd.Flags().Int("maxlife", 0, "How long to run. 0 == forever")
+	cmd.Flags().StringArray("profile", []string{}, "Load profile phase, run in the order given, driving the rate instead of --rps. The run ends after the last phase unless it has no duration. Can be used multiple times. Format: <constant|ramp|steps|sine|diurnal|burst>[,name=<name>][,duration=<duration>][,rate=<n>][,from=<n>][,to=<n>][,steps=<n>][,amplitude=<n>][,min=<n>][,max=<n>][,peak=<n>][,period=<duration>][,every=<duration>][,length=<duration>]")
+	cmd.Flags().String("profile-file", "", "File with one --profile phase per line. # starts a comment and a line with just 'loop' repeats the profile.")
+	cmd.Flags().Bool("profile-loop", false, "Start the --profile phases over after the last one.")
+	cmd.Flags().String("arrivals", "even", "How DISCOVERs are spaced at the target rate. even == evenly. poisson == exponentially distributed gaps, as from many independent clients.")
+	cmd.Flags().Int("concurrency", 0, "Closed-loop mode: this many clients on each interface each run a transaction, wait --think-time-ms, and start the next one, so the server sets the pace. --rps still caps it. 0 == open loop.")
+	cmd.Flags().Int("think-time-ms", 0, "Milliseconds a client waits after a transaction before starting its next one in closed-loop mode.")
+	cmd.Flags().Int("transaction-timeout-ms", 5000, "Milliseconds before a transaction is given up on and its client moves on in closed-loop mode.")
 	cmd.Flags().Int("mac-count", 1, "Total number of MAC addresses to use. If the 'mac' option is used, mac-count - number of mac will be used to pad with additional pre-generated MAC addresses.")
+	cmd.Flags().Bool("client-mac-source", false, "Send each client's frames, including REQUESTs, RELEASEs and ARP replies, from the client's own MAC instead of the interface's. Turns on --promisc so unicast replies to those MACs get through. Not for relay mode.")
 	cmd.Flags().Int64("mac-seed", 0, "Optional seed to use for generating MAC addresses.  This is mainly for when you want the same 'random' MACs every time.")
 	cmd.Flags().StringArray("mac", []string{}, "Optionally specified MAC address to be used for requesting leases. Can be used multiple times.")
 
 	cmd.Flags().Int("stats-rate", 5, "How frequently to update stat calculations. (seconds).")
+	cmd.Flags().Int("stats-rate-ms", 0, "How frequently to update stat calculations in milliseconds. Overrides stats-rate if set.")
+	cmd.Flags().Int("stats-history", 720, "Number of stats ticks to keep for the /stats/history API. 0 == none.")
+	cmd.Flags().Bool("stats-log", false, "Log all stats every time they are calculated.")
+	cmd.Flags().String("stats-export-address", "", "host:port to push stats to every time they are calculated. Disabled if not set.")
+	cmd.Flags().String("stats-export-protocol", "udp", "Protocol for pushing stats. udp or tcp.")
+	cmd.Flags().String("stats-export-format", "statsd", "Format for pushing stats. statsd or influx (line protocol).")
+	cmd.Flags().String("stats-export-prefix", "dhammer", "Prefix for pushed stat names.")
+	cmd.Flags().StringArray("stats-export-tag", []string{}, "Additional tag to send with pushed stats. Can be used multiple times. Format: <name>=<value>")
 
 	cmd.Flags().Bool("arp", false, "Respond to arp requests for assigned IPs.")
 	cmd.Flags().Bool("arp-fake-mac", false, "Respond to ARP requests with the generated MAC used to originally obtain the lease.  You might want to set arp_ignore to 1 or 3 for the interface sending packets. For full functionality, the --promisc option is needed.")
@@ -42,14 +68,39 @@ func prepareCmd(cmd *cobra.Command) *cobra.Command {
 	cmd.Flags().String("relay-target-server-ip", "", "Target/Destination IP for relayed requests.  relay-source-ip AND relay-target-server-ip must be set for relay mode.")
 	cmd.Flags().Int("target-port", 67, "Target port for special cases.  Rarely would you want to use this.")
 
+	cmd.Flags().String("vlan", "", "Tag clients with 802.1Q C-VLANs, spread evenly across these IDs and ranges, e.g. 1-4000 or 10,20,30-39.")
+	cmd.Flags().String("svlan", "", "Also wrap clients in 802.1ad S-VLANs from these IDs and ranges, for QinQ.  Each S-VLAN gets the full --vlan range.")
+	cmd.Flags().String("svlan-tpid", "0x88a8", "TPID for the outer tag when using --svlan.  Some networks use 0x8100 or 0x9100.")
 	cmd.Flags().StringArray("dhcp-option", []string{}, "Additional DHCP option to send out in the discover. Can be used multiple times. Format: <option num>:<RFC4648-base64-encoded-value>")
 
-	cmd.Flags().String("interface", "eth0", "Interface name for listening and sending.")
+	cmd.Flags().String("transport", "raw", "How packets are sent and received. raw == AF_PACKET socket. xdp == AF_XDP socket, falling back to raw if XDP isn't available. udp == kernel UDP socket, relay mode only. pcap == write to --pcap-file instead of the wire.")
+	cmd.Flags().StringArray("interface", []string{"eth0"}, "Interface name for listening and sending. Defaults to a made-up interface for --dry-run. Can be used multiple times, each interface getting its own share of the MACs and --rps of its own. Format: <name>[,gateway-mac=<mac>][,relay-source-ip=<ip>][,relay-gateway-ip=<ip>][,relay-target-server-ip=<ip>][,netns=<namespace>] with the top-level options as defaults.")
 	cmd.Flags().String("gateway-mac", "auto", "MAC of the gateway.")
+	cmd.Flags().String("netns", "", "Network namespace to run in, by name as in 'ip netns' or by path, e.g. /proc/<pid>/ns/net. Sockets, the gateway probe and --bind all happen there. The API server stays in the current namespace.")
 	cmd.Flags().Bool("promisc", false, "Turn on promiscuous mode for the listening interface.")
+	cmd.Flags().Bool("rx-ring", false, "Receive through a memory-mapped PACKET_RX_RING (TPACKET_V3) and hand frames to the handler in batches.")
+	cmd.Flags().Int("rx-ring-block-size", 1<<20, "Size in bytes of each RX ring block. Must be a multiple of the page size.")
+	cmd.Flags().Int("rx-ring-block-count", 64, "Number of RX ring blocks.")
+	cmd.Flags().Int("rx-ring-block-timeout", 10, "Milliseconds before the kernel hands over a block that isn't full yet.")
+	cmd.Flags().Int("rx-workers", 1, "Number of listener sockets, joined in a PACKET_FANOUT group, and handler workers. Replies are sharded across handler workers by client MAC.")
+	cmd.Flags().String("rx-fanout-mode", "lb", "How the kernel spreads frames across listener sockets when --rx-workers > 1: lb (round robin), cpu or hash. hash puts all replies from one server on one socket.")
+	cmd.Flags().String("pcap-file", "dhammer.pcapng", "File the pcap transport writes to. Files ending in .pcapng are written as pcapng, anything else as pcap.")
+	cmd.Flags().Bool("dry-run", false, "Send one DISCOVER per MAC to --pcap-file and exit. Needs no interface or privileges.")
+	cmd.Flags().String("capture-file", "", "Also write every frame sent and received to this pcapng file, annotated with direction, client MAC, xid and message type.")
+	cmd.Flags().Int("capture-max-mb", 0, "Start a new capture file once the current one passes this many megabytes. 0 == never.")
+	cmd.Flags().Int("capture-max-packets", 0, "Stop capturing after this many frames. 0 == no limit.")
+	cmd.Flags().Int("xdp-queue", 0, "NIC queue to bind the AF_XDP socket to. Replies arriving on other queues go to the kernel as usual.")
+	cmd.Flags().Int("xdp-frames", 4096, "Number of AF_XDP UMEM frames, half for receiving and half for sending. Must be a power of 2.")
+	cmd.Flags().Bool("xdp-copy", false, "Don't try AF_XDP zero-copy mode.")
+	cmd.Flags().Int("rcvbuf", 0, "SO_RCVBUF size in bytes for the raw and udp transports. Raise it if KernelRxDrops shows replies being dropped. 0 == kernel default.")
+	cmd.Flags().Int("sndbuf", 0, "SO_SNDBUF size in bytes for the raw and udp transports. 0 == kernel default.")
+	cmd.Flags().Int("tx-batch-size", 1, "Max number of frames to send per sendmmsg call. 1 == one write per frame.")
+	cmd.Flags().String("bpf-filter", "", "pcap-filter expression for the socket filter, replacing the one built from the other options. See 'dhammer filter --help' for what's supported.")
+	cmd.Flags().Bool("print-filter", false, "Print the socket filter this run would use, as an expression and compiled, and exit.")
+	cmd.Flags().Int("tx-flush-interval-us", 0, "Microseconds to wait for a TX batch to fill before sending it anyway. 0 == send whatever is queued right away.")
 
 	cmd.Flags().String("api-address", "", "IP for the API server to listen on.")
-	cmd.Flags().Int("api-port", 8080, "Port for the API server to listen on.")
+	cmd.Flags().Int("api-port", 8080, "Port for the API server to listen on. 0 == no API server, which is always the case for --dry-run.")
 
 	return cmd
 }
@@ -62,26 +113,28 @@ func getVal(i interface{}, err error) interface{} {
 	return i
 }
 
-func arp(n string, l netlink.Link, i net.IP) (net.HardwareAddr, error) {
+func arp(o *config.SocketeerOptions, nl *netlink.Handle, l netlink.Link, i net.IP) (net.HardwareAddr, error) {
 
-	srcAddr := getVal(netlink.AddrList(l, netlink.FAMILY_V4)).([]netlink.Addr)[0]
+	srcAddr := getVal(nl.AddrList(l, netlink.FAMILY_V4)).([]netlink.Addr)[0]
 
-	s := socketeer.NewRawSocketeer(&config.SocketeerOptions{InterfaceName: n}, func(s string) bool { return true }, func(e error) bool { println(e); return true })
+	s := socketeer.NewRawSocketeer(&config.SocketeerOptions{InterfaceName: o.InterfaceName}, func(s string) bool { return true }, func(e error) bool { println(e); return true })
 
-	if err := s.Init(); err != nil {
+	if err := namespace.Do(o.Netns, s.Init); err != nil {
 		return nil, err
 	}
 
 	arpReplies := make(chan net.HardwareAddr)
 
-	s.SetReceiver(func(msg message.Message) bool {
-		if msg.Packet.Layer(layers.LayerTypeARP) != nil {
-			arpMsg := msg.Packet.Layer(layers.LayerTypeARP).(*layers.ARP)
-			if arpMsg.Operation == layers.ARPReply {
-				if net.IP(arpMsg.SourceProtAddress).String() == i.String() {
-					select {
-					case arpReplies <- arpMsg.SourceHwAddress:
-					default:
+	s.SetReceiver(func(msgs []message.Message) bool {
+		for _, msg := range msgs {
+			if msg.Packet.Layer(layers.LayerTypeARP) != nil {
+				arpMsg := msg.Packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+				if arpMsg.Operation == layers.ARPReply {
+					if net.IP(arpMsg.SourceProtAddress).String() == i.String() {
+						select {
+						case arpReplies <- arpMsg.SourceHwAddress:
+						default:
+						}
 					}
 				}
 			}
@@ -166,6 +219,82 @@ func arp(n string, l netlink.Link, i net.IP) (net.HardwareAddr, error) {
 	return gwMac, nil
 }
 
+// parseInterface splits an --interface value into the name and its key=value settings.
+func parseInterface(spec string) (string, map[string]string) {
+
+	parts := strings.Split(spec, ",")
+	settings := make(map[string]string)
+
+	for _, p := range parts[1:] {
+		keyValCombo := strings.SplitN(p, "=", 2)
+		if len(keyValCombo) != 2 {
+			panic("Interface settings must be in the format <name>=<value>: " + spec)
+		}
+		settings[keyValCombo[0]] = keyValCombo[1]
+	}
+
+	return parts[0], settings
+}
+
+// perInterfaceFile puts the interface name (and namespace) in front of the extension, so lanes don't write over each other.
+func perInterfaceFile(file string, o *config.SocketeerOptions) string {
+
+	if file == "" {
+		return ""
+	}
+
+	suffix := o.InterfaceName
+	if o.Netns != "" {
+		suffix = strings.Replace(strings.Trim(o.Netns, "/"), "/", "_", -1) + "-" + suffix
+	}
+
+	ext := filepath.Ext(file)
+
+	return strings.TrimSuffix(file, ext) + "-" + suffix + ext
+}
+
+// resolveGatewayMAC only fails for want of a default route when needed, i.e. for relaying or without ethernet broadcast.
+func resolveGatewayMAC(gatewayMAC string, needed bool, socketeerOptions *config.SocketeerOptions) (net.HardwareAddr, error) {
+
+	if gatewayMAC != "auto" {
+		return net.ParseMAC(gatewayMAC)
+	}
+
+	if socketeerOptions.Transport == "udp" || socketeerOptions.Transport == "pcap" {
+		// Either the kernel routes for us or nothing goes on the wire.
+		return net.HardwareAddr{0, 0, 0, 0, 0, 0}, nil
+	}
+
+	// netlink and arp to get the gw IP and then ARP to get the MAC
+	nl, err := namespace.Netlink(socketeerOptions.Netns)
+	if err != nil {
+		return nil, err
+	}
+	defer nl.Delete()
+
+	link, err := nl.LinkByName(socketeerOptions.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := nl.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range routes {
+		if r.Dst == nil && r.Src == nil { // We've found the default route.
+			return arp(socketeerOptions, nl, link, r.Gw)
+		}
+	}
+
+	if !needed {
+		return nil, nil
+	}
+
+	return nil, errors.New("no default route on " + socketeerOptions.InterfaceName + " to find the gateway MAC with")
+}
+
 func init() {
 
 	rootCmd.AddCommand(prepareCmd(&cobra.Command{
@@ -188,16 +317,72 @@ func init() {
 			options.DhcpDecline = getVal(cmd.Flags().GetBool("decline")).(bool)
 
 			options.RequestsPerSecond = getVal(cmd.Flags().GetInt("rps")).(int)
+			options.Burst = getVal(cmd.Flags().GetInt("burst")).(int)
 			options.MaxLifetime = getVal(cmd.Flags().GetInt("maxlife")).(int)
 			options.MacCount = getVal(cmd.Flags().GetInt("mac-count")).(int)
+
+			profileSpecs := getVal(cmd.Flags().GetStringArray("profile")).([]string)
+			profileFile := getVal(cmd.Flags().GetString("profile-file")).(string)
+
+			if len(profileSpecs) > 0 && profileFile != "" {
+				panic("Use either --profile or --profile-file, not both.")
+			} else if len(profileSpecs) > 0 {
+				options.Profile = getVal(profile.New(profileSpecs, getVal(cmd.Flags().GetBool("profile-loop")).(bool))).(*profile.Profile)
+			} else if profileFile != "" {
+				options.Profile = getVal(profile.Load(profileFile)).(*profile.Profile)
+			}
+
+			switch arrivals := getVal(cmd.Flags().GetString("arrivals")).(string); arrivals {
+			case "even":
+			case "poisson":
+				options.PoissonArrivals = true
+			default:
+				panic("Unknown arrivals: " + arrivals)
+			}
+
+			options.Concurrency = getVal(cmd.Flags().GetInt("concurrency")).(int)
+			options.ThinkTime = time.Duration(getVal(cmd.Flags().GetInt("think-time-ms")).(int)) * time.Millisecond
+			transactionTimeout := time.Duration(getVal(cmd.Flags().GetInt("transaction-timeout-ms")).(int)) * time.Millisecond
+
+			if options.Concurrency > 0 {
+				if options.Profile != nil || options.PoissonArrivals {
+					panic("--concurrency lets the server set the pace, so it can't be combined with --profile or --arrivals poisson.")
+				}
+
+				if transactionTimeout <= 0 {
+					panic("--transaction-timeout-ms has to be more than 0.")
+				}
+			}
 			options.MacSeed = getVal(cmd.Flags().GetInt64("mac-seed")).(int64)
 			options.SpecifiedMacs = getVal(cmd.Flags().GetStringArray("mac")).([]string)
+			options.ClientSourceMAC = getVal(cmd.Flags().GetBool("client-mac-source")).(bool)
 
 			if options.MacCount <= 0 && len(options.SpecifiedMacs) == 0 {
 				panic("At least one of mac-count or mac options must be used.")
 			}
 
-			options.StatsRate = getVal(cmd.Flags().GetInt("stats-rate")).(int)
+			statsRate := getVal(cmd.Flags().GetInt("stats-rate")).(int)
+			statsRateMs := getVal(cmd.Flags().GetInt("stats-rate-ms")).(int)
+			options.StatsLog = getVal(cmd.Flags().GetBool("stats-log")).(bool)
+			options.StatsHistorySize = getVal(cmd.Flags().GetInt("stats-history")).(int)
+
+			if options.StatsHistorySize < 0 {
+				panic("--stats-history can't be negative.")
+			}
+
+			options.StatsExportAddress = getVal(cmd.Flags().GetString("stats-export-address")).(string)
+			options.StatsExportProtocol = getVal(cmd.Flags().GetString("stats-export-protocol")).(string)
+			options.StatsExportFormat = getVal(cmd.Flags().GetString("stats-export-format")).(string)
+			options.StatsExportPrefix = getVal(cmd.Flags().GetString("stats-export-prefix")).(string)
+
+			options.StatsExportTags = make(map[string]string)
+			for _, t := range getVal(cmd.Flags().GetStringArray("stats-export-tag")).([]string) {
+				tagValCombo := strings.SplitN(t, "=", 2)
+				if len(tagValCombo) != 2 {
+					panic("Stats export tags must be in the format <name>=<value>: " + t)
+				}
+				options.StatsExportTags[tagValCombo[0]] = tagValCombo[1]
+			}
 
 			options.Arp = getVal(cmd.Flags().GetBool("arp")).(bool)
 			options.ArpFakeMAC = getVal(cmd.Flags().GetBool("arp-fake-mac")).(bool)
@@ -210,79 +395,218 @@ func init() {
 			options.TargetPort = getVal(cmd.Flags().GetInt("target-port")).(int)
 			options.AdditionalDhcpOptions = getVal(cmd.Flags().GetStringArray("dhcp-option")).([]string)
 
-			socketeerOptions.InterfaceName = getVal(cmd.Flags().GetString("interface")).(string)
+			cVlans := getVal(cmd.Flags().GetString("vlan")).(string)
+			sVlans := getVal(cmd.Flags().GetString("svlan")).(string)
+			sVlanTPID := getVal(cmd.Flags().GetString("svlan-tpid")).(string)
+
+			if sVlans != "" && cVlans == "" {
+				panic("--svlan needs --vlan for the inner tags.")
+			}
+
+			if cVlans != "" {
+				cIDs := getVal(vlan.ParseRanges(cVlans)).([]uint16)
+				var sIDs []uint16
+
+				if sVlans != "" {
+					sIDs = getVal(vlan.ParseRanges(sVlans)).([]uint16)
+				}
+
+				tpid := getVal(strconv.ParseUint(sVlanTPID, 0, 16)).(uint64)
+
+				options.Vlans = getVal(vlan.NewPlan(layers.EthernetType(tpid), sIDs, cIDs)).(*vlan.Plan)
+			}
+
+			socketeerOptions.Transport = getVal(cmd.Flags().GetString("transport")).(string)
+			interfaces := getVal(cmd.Flags().GetStringArray("interface")).([]string)
 			gatewayMAC := getVal(cmd.Flags().GetString("gateway-mac")).(string)
+			socketeerOptions.Netns = getVal(cmd.Flags().GetString("netns")).(string)
 			socketeerOptions.PromiscuousMode = getVal(cmd.Flags().GetBool("promisc")).(bool)
+			socketeerOptions.RxRing = getVal(cmd.Flags().GetBool("rx-ring")).(bool)
+			socketeerOptions.RxRingBlockSize = getVal(cmd.Flags().GetInt("rx-ring-block-size")).(int)
+			socketeerOptions.RxRingBlockCount = getVal(cmd.Flags().GetInt("rx-ring-block-count")).(int)
+			socketeerOptions.RxRingBlockTimeout = getVal(cmd.Flags().GetInt("rx-ring-block-timeout")).(int)
+			socketeerOptions.RxWorkers = getVal(cmd.Flags().GetInt("rx-workers")).(int)
+			socketeerOptions.RxFanoutMode = getVal(cmd.Flags().GetString("rx-fanout-mode")).(string)
+			socketeerOptions.PcapFile = getVal(cmd.Flags().GetString("pcap-file")).(string)
+			options.DryRun = getVal(cmd.Flags().GetBool("dry-run")).(bool)
+
+			if options.DryRun {
+				if options.Profile != nil {
+					panic("A dry run isn't paced, so it can't follow a load profile.")
+				}
+
+				if options.Concurrency > 0 {
+					panic("Nothing answers a dry run, so it can't run in closed-loop mode.")
+				}
+
+				socketeerOptions.Transport = "pcap"
+
+				// A real eth0 would lend the frames its MAC, and the output should be the same on any host.
+				if !cmd.Flags().Changed("interface") {
+					interfaces = []string{"dry-run"}
+				}
+			}
+
+			if options.Vlans != nil && (socketeerOptions.Transport == "udp" || socketeerOptions.Transport == "xdp") {
+				panic("VLAN tagging needs the raw or pcap transport.")
+			}
+
+			if options.ClientSourceMAC {
+				if socketeerOptions.Transport == "udp" {
+					panic("--client-mac-source needs the raw, xdp or pcap transport.")
+				}
+
+				// Servers unicast to the client's MAC, which the NIC would otherwise drop.
+				socketeerOptions.PromiscuousMode = true
+			}
+
+			socketeerOptions.CaptureFile = getVal(cmd.Flags().GetString("capture-file")).(string)
+			socketeerOptions.CaptureMaxBytes = int64(getVal(cmd.Flags().GetInt("capture-max-mb")).(int)) << 20
+			socketeerOptions.CaptureMaxPackets = getVal(cmd.Flags().GetInt("capture-max-packets")).(int)
+			socketeerOptions.XdpQueueID = getVal(cmd.Flags().GetInt("xdp-queue")).(int)
+			socketeerOptions.XdpFrameCount = getVal(cmd.Flags().GetInt("xdp-frames")).(int)
+			socketeerOptions.XdpCopyMode = getVal(cmd.Flags().GetBool("xdp-copy")).(bool)
+			socketeerOptions.XdpRedirectArp = options.Arp
+			socketeerOptions.RcvBuf = getVal(cmd.Flags().GetInt("rcvbuf")).(int)
+			socketeerOptions.SndBuf = getVal(cmd.Flags().GetInt("sndbuf")).(int)
+			socketeerOptions.TxBatchSize = getVal(cmd.Flags().GetInt("tx-batch-size")).(int)
+
+			if socketeerOptions.TxBatchSize < 1 {
+				panic("--tx-batch-size has to be at least 1.")
+			}
+
+			socketeerOptions.TxFlushInterval = time.Duration(getVal(cmd.Flags().GetInt("tx-flush-interval-us")).(int)) * time.Microsecond
+			bpfFilter := getVal(cmd.Flags().GetString("bpf-filter")).(string)
+			printFilter := getVal(cmd.Flags().GetBool("print-filter")).(bool)
 
 			ApiAddress := getVal(cmd.Flags().GetString("api-address")).(string)
 			ApiPort := getVal(cmd.Flags().GetInt("api-port")).(int)
 
-			options.RelaySourceIP = net.ParseIP(relayIP)
-			options.RelayGatewayIP = net.ParseIP(relayGatewayIP)
-			options.RelayTargetServerIP = net.ParseIP(targetServerIP)
+			if options.DryRun {
+				ApiPort = 0
+			}
 
-			if options.RelayGatewayIP == nil {
-				options.RelayGatewayIP = options.RelaySourceIP
+			if statsRateMs > 0 {
+				options.StatsInterval = time.Duration(statsRateMs) * time.Millisecond
+			} else if statsRate > 0 {
+				options.StatsInterval = time.Duration(statsRate) * time.Second
+			} else {
+				options.StatsInterval = 5 * time.Second
 			}
 
-			if options.RelaySourceIP != nil && options.RelayTargetServerIP != nil {
-				options.DhcpRelay = true
+			if len(interfaces) == 0 {
+				panic("At least one interface is needed.")
 			}
 
-			// netlink and arp to get the gw IP and then ARP to get the MAC
-			if gatewayMAC == "auto" {
-				link := getVal(netlink.LinkByName(socketeerOptions.InterfaceName)).(netlink.Link)
-				routes := getVal(netlink.RouteList(link, netlink.FAMILY_V4)).([]netlink.Route)
+			if len(interfaces) > 1 {
+				if options.MacCount < len(interfaces) {
+					panic("Need at least as many MACs as interfaces.")
+				}
+
+				// All interfaces have to generate the same list to split it between them.
+				if options.MacSeed == 0 {
+					options.MacSeed = time.Now().UnixNano()
+				}
+			}
+
+			lanes := make([]hammer.Interface, 0, len(interfaces))
+
+			for i, spec := range interfaces {
+				name, settings := parseInterface(spec)
 
-				for _, r := range routes {
-					if r.Dst == nil && r.Src == nil { // We've found the default route.
-						socketeerOptions.GatewayMAC = getVal(arp(socketeerOptions.InterfaceName, link, r.Gw)).(net.HardwareAddr)
-						break
+				laneOptions := *options
+				laneSocketeerOptions := *socketeerOptions
+
+				laneSocketeerOptions.InterfaceName = name
+				laneOptions.MacPartition = i
+				laneOptions.MacPartitions = len(interfaces)
+
+				if options.Concurrency > 0 {
+					laneOptions.Transactions = transaction.NewTracker(options.Concurrency, transactionTimeout)
+				}
+
+				laneRelayIP, laneRelayGatewayIP, laneTargetServerIP, laneGatewayMAC := relayIP, relayGatewayIP, targetServerIP, gatewayMAC
+
+				for k, v := range settings {
+					switch k {
+					case "gateway-mac":
+						laneGatewayMAC = v
+					case "relay-source-ip":
+						laneRelayIP = v
+					case "relay-gateway-ip":
+						laneRelayGatewayIP = v
+					case "relay-target-server-ip":
+						laneTargetServerIP = v
+					case "netns":
+						laneSocketeerOptions.Netns = v
+					default:
+						panic("Unknown interface setting " + k + " in " + spec)
 					}
 				}
-			} else {
-				socketeerOptions.GatewayMAC, err = net.ParseMAC(gatewayMAC)
-				if err != nil {
-					panic(err)
+
+				if len(interfaces) > 1 {
+					laneSocketeerOptions.PcapFile = perInterfaceFile(laneSocketeerOptions.PcapFile, &laneSocketeerOptions)
+					laneSocketeerOptions.CaptureFile = perInterfaceFile(laneSocketeerOptions.CaptureFile, &laneSocketeerOptions)
+				}
+
+				laneOptions.RelaySourceIP = net.ParseIP(laneRelayIP)
+				laneOptions.RelayGatewayIP = net.ParseIP(laneRelayGatewayIP)
+				laneOptions.RelayTargetServerIP = net.ParseIP(laneTargetServerIP)
+
+				if laneOptions.RelayGatewayIP == nil {
+					laneOptions.RelayGatewayIP = laneOptions.RelaySourceIP
+				}
+
+				if laneOptions.RelaySourceIP != nil && laneOptions.RelayTargetServerIP != nil {
+					laneOptions.DhcpRelay = true
+				}
+
+				if laneOptions.DhcpRelay {
+					laneSocketeerOptions.UdpSourceIP = laneOptions.RelaySourceIP
+				}
+
+				// Replies come to the client port, or to the relay on the server port, which might be --target-port.
+				laneSocketeerOptions.XdpPorts = []int{68}
+
+				if laneOptions.DhcpRelay {
+					laneSocketeerOptions.XdpPorts = []int{67}
+
+					if laneOptions.TargetPort != 67 {
+						laneSocketeerOptions.XdpPorts = append(laneSocketeerOptions.XdpPorts, laneOptions.TargetPort)
+					}
 				}
+
+				if laneOptions.DhcpRelay && laneOptions.ClientSourceMAC {
+					panic("--client-mac-source doesn't work in relay mode, where frames come from the relay.")
+				}
+
+				laneFilter := bpfFilter
+
+				if laneFilter == "" {
+					laneFilter = filter.ForDhcpV4(&laneOptions)
+				}
+
+				program := getVal(filter.Compile(laneFilter)).([]unix.SockFilter)
+
+				if printFilter {
+					if len(interfaces) > 1 {
+						fmt.Printf("# %s\n", name)
+					}
+					fmt.Printf("%s\n\n%s", laneFilter, filter.Dump(program))
+					continue
+				}
+
+				laneSocketeerOptions.EbpfFilter = &unix.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+				laneSocketeerOptions.GatewayMAC = getVal(resolveGatewayMAC(laneGatewayMAC, laneOptions.DhcpRelay || !laneOptions.EthernetBroadcast, &laneSocketeerOptions)).(net.HardwareAddr)
+
+				lanes = append(lanes, hammer.Interface{Options: &laneOptions, SocketeerOptions: &laneSocketeerOptions})
 			}
 
-			if options.StatsRate <= 0 {
-				options.StatsRate = 5
+			if printFilter {
+				return
 			}
 
-			filter := [28]unix.SockFilter{{0x28, 0, 0, 0x0000000c}, // "arp or (port 67 or port 68)"
-				{0x15, 24, 0, 0x00000806},
-				{0x15, 0, 9, 0x000086dd},
-				{0x30, 0, 0, 0x00000014},
-				{0x15, 2, 0, 0x00000084},
-				{0x15, 1, 0, 0x00000006},
-				{0x15, 0, 20, 0x00000011},
-				{0x28, 0, 0, 0x00000036},
-				{0x15, 17, 0, 0x00000043},
-				{0x15, 16, 0, 0x00000044},
-				{0x28, 0, 0, 0x00000038},
-				{0x15, 14, 13, 0x00000043},
-				{0x15, 0, 14, 0x00000800},
-				{0x30, 0, 0, 0x00000017},
-				{0x15, 2, 0, 0x00000084},
-				{0x15, 1, 0, 0x00000006},
-				{0x15, 0, 10, 0x00000011},
-				{0x28, 0, 0, 0x00000014},
-				{0x45, 8, 0, 0x00001fff},
-				{0xb1, 0, 0, 0x0000000e},
-				{0x48, 0, 0, 0x0000000e},
-				{0x15, 4, 0, 0x00000043},
-				{0x15, 3, 0, 0x00000044},
-				{0x48, 0, 0, 0x00000010},
-				{0x15, 1, 0, 0x00000043},
-				{0x15, 0, 1, 0x00000044},
-				{0x6, 0, 0, 0x00040000},
-				{0x6, 0, 0, 0x00000000}}
-
-			socketeerOptions.EbpfFilter = &unix.SockFprog{28, &filter[0]}
-
-			gHammer = hammer.New(socketeerOptions, options)
+			gHammer = hammer.New(options, lanes)
 
 			err = gHammer.Init(ApiAddress, ApiPort)
 
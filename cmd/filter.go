@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/ipchama/dhammer/filter"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+func init() {
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "filter <expression>",
+		Short: "Compile a socket filter expression and print the program.",
+		Long: `Compile a pcap-filter style expression to classic BPF and print the program, like tcpdump -d.
+
+Supported:  arp, ip, ip6, udp, tcp, icmp, icmp6, [udp|tcp] [src|dst] port N, [src|dst] host A.B.C.D,
+ether [src|dst] host MAC, vlan [ID], and/or/not and parentheses.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			program := getVal(filter.Compile(strings.Join(args, " "))).([]unix.SockFilter)
+			fmt.Print(filter.Dump(program))
+		},
+	})
+
+}
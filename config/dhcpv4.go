@@ -1,7 +1,11 @@
 package config
 
 import (
+	"github.com/ipchama/dhammer/profile"
+	"github.com/ipchama/dhammer/transaction"
+	"github.com/ipchama/dhammer/vlan"
 	"net"
+	"time"
 )
 
 type DhcpV4Options struct {
@@ -24,14 +28,38 @@ type DhcpV4Options struct {
 
 	AdditionalDhcpOptions []string
 
+	Vlans *vlan.Plan // nil when clients aren't tagged.
+
 	RequestsPerSecond int
+	Burst             int
 	MaxLifetime       int
+	DryRun            bool
+
+	Profile *profile.Profile // Drives the rate over time instead of RequestsPerSecond when set.
+
+	PoissonArrivals bool // Exponentially distributed gaps between DISCOVERs instead of even ones.
+
+	Concurrency  int // Clients with a transaction in flight at once in closed-loop mode.  0 == open loop.
+	ThinkTime    time.Duration
+	Transactions *transaction.Tracker // nil in open-loop mode.
+
+	ClientSourceMAC bool // Send each client's frames from its own MAC instead of the interface's.
 
 	MacCount      int
 	SpecifiedMacs []string
 	MacSeed       int64
+	MacPartition  int // Which share of the MACs this interface gets, out of MacPartitions.
+	MacPartitions int
+
+	StatsInterval    time.Duration
+	StatsLog         bool
+	StatsHistorySize int
 
-	StatsRate int
+	StatsExportAddress  string
+	StatsExportProtocol string
+	StatsExportFormat   string
+	StatsExportPrefix   string
+	StatsExportTags     map[string]string
 }
 
 func (o *DhcpV4Options) HammerType() string {
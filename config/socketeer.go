@@ -3,11 +3,42 @@ package config
 import (
 	"golang.org/x/sys/unix"
 	"net"
+	"time"
 )
 
 type SocketeerOptions struct {
+	Transport       string
 	InterfaceName   string
+	Netns           string // Network namespace name or path.  "" == the one we're in.
 	GatewayMAC      net.HardwareAddr
 	PromiscuousMode bool
 	EbpfFilter      *unix.SockFprog
+
+	RcvBuf int // Socket buffer sizes in bytes.  0 == kernel default.
+	SndBuf int
+
+	RxRing             bool
+	RxRingBlockSize    int
+	RxRingBlockCount   int
+	RxRingBlockTimeout int
+
+	RxWorkers    int
+	RxFanoutMode string
+
+	XdpQueueID     int
+	XdpFrameCount  int
+	XdpCopyMode    bool
+	XdpRedirectArp bool
+	XdpPorts       []int // UDP destination ports of the replies to redirect.
+
+	UdpSourceIP net.IP
+
+	PcapFile string
+
+	CaptureFile       string
+	CaptureMaxBytes   int64
+	CaptureMaxPackets int
+
+	TxBatchSize     int
+	TxFlushInterval time.Duration
 }
@@ -0,0 +1,723 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ipchama/dhammer/config"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+	A small pcap-filter compiler, so the socket filter can be built from the run's options instead of pasting in
+	tcpdump -dd output, and so users can pass their own without needing libpcap.
+
+	Supported:
+
+		arp, ip, ip6, udp, tcp, icmp, icmp6
+		[udp|tcp] [src|dst] port N
+		[src|dst] host A.B.C.D
+		ether [src|dst] host MAC
+		vlan [ID]
+		and (&&), or (||), not (!), parentheses
+
+	As with pcap, "vlan" shifts the offsets of everything after it in the same "and" chain by the tag.  It also
+	matches tags the kernel has already stripped off into packet metadata, which is the usual case on Linux.  The
+	kernel only ever strips the outer tag, so only the outermost "vlan" in a chain looks at the metadata.
+*/
+
+const (
+	snapLen = 0x40000
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeARP  = 0x0806
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protoICMP  = 1
+	protoTCP   = 6
+	protoUDP   = 17
+	protoICMP6 = 58
+
+	// Ancillary loads, see SKF_AD_* in linux/filter.h
+	skfAdOff             = 0xfffff000
+	skfAdVlanTag         = 44
+	skfAdVlanTagPresent  = 48
+	baseL3Offset         = 14
+	vlanTagLength        = 4
+	ipv4FragmentMask     = 0x1fff
+	vlanIDMask           = 0x0fff
+	ipv6HeaderLength     = 40
+	jumpLimit            = 255
+	directionEither      = 0
+	directionSource      = 1
+	directionDestination = 2
+)
+
+// Classic BPF opcodes
+const (
+	ldW    = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	ldH    = unix.BPF_LD | unix.BPF_H | unix.BPF_ABS
+	ldB    = unix.BPF_LD | unix.BPF_B | unix.BPF_ABS
+	ldIndH = unix.BPF_LD | unix.BPF_H | unix.BPF_IND
+	ldxMsh = unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH
+	andK   = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	jeqK   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	jsetK  = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+	ja     = unix.BPF_JMP | unix.BPF_JA
+	retK   = unix.BPF_RET | unix.BPF_K
+)
+
+/******** Parsing ********/
+
+type node interface {
+	compile(a *assembler, t int, f int)
+}
+
+type andNode struct{ left, right node }
+type orNode struct{ left, right node }
+type notNode struct{ n node }
+type trueNode struct{}
+
+type etherTypeNode struct {
+	l3      int
+	ethType uint32
+}
+
+type protoNode struct {
+	l3    int
+	ipv4  bool
+	ipv6  bool
+	proto uint32
+}
+
+type portNode struct {
+	l3        int
+	protos    []uint32
+	direction int
+	port      uint32
+}
+
+type hostNode struct {
+	l3        int
+	direction int
+	ip        uint32
+}
+
+type etherHostNode struct {
+	direction int
+	mac       net.HardwareAddr
+}
+
+type vlanNode struct {
+	l3         int
+	id         int  // -1 for any
+	inlineOnly bool // An outer vlan already used up the tag the kernel stripped, if there was one.
+
+	restStripped node // The rest of the "and" chain, for tags already stripped by the kernel.
+	restInline   node // The rest of the "and" chain, shifted past an inline tag.
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+	inVlan bool
+}
+
+func tokenize(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr(l3 int) (node, error) {
+	left, err := p.parseAnd(l3)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" {
+		p.next()
+
+		right, err := p.parseAnd(l3)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd(l3 int) (node, error) {
+
+	if p.peek() == "vlan" {
+		return p.parseVlan(l3)
+	}
+
+	left, err := p.parseUnary(l3)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" {
+		p.next()
+
+		if p.peek() == "vlan" {
+			right, err := p.parseVlan(l3)
+			if err != nil {
+				return nil, err
+			}
+			return &andNode{left, right}, nil
+		}
+
+		right, err := p.parseUnary(l3)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+// parseVlan parses "vlan [ID]" and the rest of its "and" chain twice, once for each place the tag can be.
+func (p *parser) parseVlan(l3 int) (node, error) {
+	p.next()
+
+	v := &vlanNode{l3: l3, id: -1, inlineOnly: p.inVlan, restStripped: trueNode{}, restInline: trueNode{}}
+
+	if id, err := strconv.Atoi(p.peek()); err == nil {
+		if id < 0 || id > vlanIDMask {
+			return nil, errors.New("VLAN ID out of range: " + p.peek())
+		}
+		v.id = id
+		p.next()
+	}
+
+	if p.peek() != "and" {
+		return v, nil
+	}
+	p.next()
+
+	start := p.pos
+	outer := p.inVlan
+	p.inVlan = true
+
+	defer func() { p.inVlan = outer }()
+
+	var err error
+
+	if v.restStripped, err = p.parseAnd(l3); err != nil {
+		return nil, err
+	}
+
+	p.pos = start
+
+	if v.restInline, err = p.parseAnd(l3 + vlanTagLength); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (p *parser) parseUnary(l3 int) (node, error) {
+
+	switch p.peek() {
+	case "not":
+		p.next()
+		n, err := p.parseUnary(l3)
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+
+	case "(":
+		p.next()
+		n, err := p.parseOr(l3)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("Missing )")
+		}
+		return n, nil
+	}
+
+	return p.parsePrimitive(l3)
+}
+
+func (p *parser) parseDirection() int {
+	switch p.peek() {
+	case "src":
+		p.next()
+		return directionSource
+	case "dst":
+		p.next()
+		return directionDestination
+	}
+	return directionEither
+}
+
+func (p *parser) parsePrimitive(l3 int) (node, error) {
+
+	tok := p.next()
+
+	switch tok {
+	case "arp":
+		return &etherTypeNode{l3, etherTypeARP}, nil
+	case "ip":
+		return &etherTypeNode{l3, etherTypeIPv4}, nil
+	case "ip6":
+		return &etherTypeNode{l3, etherTypeIPv6}, nil
+	case "icmp":
+		return &protoNode{l3: l3, ipv4: true, proto: protoICMP}, nil
+	case "icmp6":
+		return &protoNode{l3: l3, ipv6: true, proto: protoICMP6}, nil
+
+	case "udp", "tcp":
+		proto := uint32(protoUDP)
+		if tok == "tcp" {
+			proto = protoTCP
+		}
+
+		if next := p.peek(); next == "port" || next == "src" || next == "dst" {
+			return p.parsePort(l3, []uint32{proto})
+		}
+
+		return &protoNode{l3: l3, ipv4: true, ipv6: true, proto: proto}, nil
+
+	case "src", "dst", "port", "host":
+		p.pos--
+		start := p.pos
+		direction := p.parseDirection()
+
+		switch p.peek() {
+		case "port":
+			p.pos = start
+			return p.parsePort(l3, []uint32{protoUDP, protoTCP})
+		case "host":
+			p.next()
+			return p.parseHost(l3, direction)
+		}
+
+		return nil, errors.New("Expected port or host after " + tok)
+
+	case "ether":
+		direction := p.parseDirection()
+
+		if p.next() != "host" {
+			return nil, errors.New("Expected host after ether")
+		}
+
+		mac, err := net.ParseMAC(p.next())
+		if err != nil || len(mac) != 6 {
+			return nil, errors.New("Bad MAC address for ether host")
+		}
+
+		return &etherHostNode{direction, mac}, nil
+
+	case "":
+		return nil, errors.New("Unexpected end of filter expression")
+	}
+
+	return nil, errors.New("Unknown filter primitive: " + tok)
+}
+
+func (p *parser) parsePort(l3 int, protos []uint32) (node, error) {
+	direction := p.parseDirection()
+
+	if p.next() != "port" {
+		return nil, errors.New("Expected port")
+	}
+
+	tok := p.next()
+	port, err := strconv.Atoi(tok)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, errors.New("Bad port: " + tok)
+	}
+
+	return &portNode{l3: l3, protos: protos, direction: direction, port: uint32(port)}, nil
+}
+
+func (p *parser) parseHost(l3 int, direction int) (node, error) {
+	tok := p.next()
+
+	ip := net.ParseIP(tok).To4()
+	if ip == nil {
+		return nil, errors.New("Only IPv4 hosts are supported: " + tok)
+	}
+
+	return &hostNode{l3: l3, direction: direction, ip: uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])}, nil
+}
+
+/******** Code generation ********/
+
+type instruction struct {
+	code   uint16
+	k      uint32
+	jt, jf int // Labels, for conditional jumps.
+	jump   int // Label, for ja.
+}
+
+type assembler struct {
+	insns  []instruction
+	labels []int // Label -> instruction index
+}
+
+func (a *assembler) newLabel() int {
+	a.labels = append(a.labels, -1)
+	return len(a.labels) - 1
+}
+
+func (a *assembler) place(label int) {
+	a.labels[label] = len(a.insns)
+}
+
+func (a *assembler) emit(code uint16, k uint32) {
+	a.insns = append(a.insns, instruction{code: code, k: k, jt: -1, jf: -1, jump: -1})
+}
+
+func (a *assembler) cond(code uint16, k uint32, t int, f int) {
+	a.insns = append(a.insns, instruction{code: code, k: k, jt: t, jf: f, jump: -1})
+}
+
+func (a *assembler) jumpTo(label int) {
+	a.insns = append(a.insns, instruction{code: ja, jt: -1, jf: -1, jump: label})
+}
+
+func (a *assembler) assemble() ([]unix.SockFilter, error) {
+
+	prog := make([]unix.SockFilter, len(a.insns))
+
+	for i, in := range a.insns {
+		prog[i] = unix.SockFilter{Code: in.code, K: in.k}
+
+		if in.jump >= 0 {
+			prog[i].K = uint32(a.labels[in.jump] - i - 1)
+		}
+
+		if in.jt >= 0 {
+			jt := a.labels[in.jt] - i - 1
+			jf := a.labels[in.jf] - i - 1
+
+			if jt < 0 || jf < 0 || jt > jumpLimit || jf > jumpLimit {
+				return nil, errors.New("Filter is too large to compile")
+			}
+
+			prog[i].Jt = uint8(jt)
+			prog[i].Jf = uint8(jf)
+		}
+	}
+
+	return prog, nil
+}
+
+func (n *andNode) compile(a *assembler, t int, f int) {
+	m := a.newLabel()
+	n.left.compile(a, m, f)
+	a.place(m)
+	n.right.compile(a, t, f)
+}
+
+func (n *orNode) compile(a *assembler, t int, f int) {
+	m := a.newLabel()
+	n.left.compile(a, t, m)
+	a.place(m)
+	n.right.compile(a, t, f)
+}
+
+func (n *notNode) compile(a *assembler, t int, f int) {
+	n.n.compile(a, f, t)
+}
+
+func (n trueNode) compile(a *assembler, t int, f int) {
+	a.jumpTo(t)
+}
+
+func (n *etherTypeNode) compile(a *assembler, t int, f int) {
+	a.emit(ldH, uint32(n.l3-2))
+	a.cond(jeqK, n.ethType, t, f)
+}
+
+// ipProto checks the IPv4 protocol or IPv6 next header against protos, going to t on a match.
+func ipProto(a *assembler, l3 int, ipv4 bool, ipv6 bool, protos []uint32, t4 int, t6 int, f int) {
+
+	v4 := a.newLabel()
+	v6 := a.newLabel()
+
+	a.emit(ldH, uint32(l3-2))
+
+	if ipv4 && ipv6 {
+		a.cond(jeqK, etherTypeIPv4, v4, v6)
+	} else if ipv4 {
+		a.cond(jeqK, etherTypeIPv4, v4, f)
+	} else {
+		a.cond(jeqK, etherTypeIPv6, v6, f)
+	}
+
+	if ipv4 {
+		a.place(v4)
+		a.emit(ldB, uint32(l3+9))
+		protoChain(a, protos, t4, f)
+	}
+
+	if ipv6 {
+		a.place(v6)
+		if ipv4 {
+			a.cond(jeqK, etherTypeIPv6, a.nextInsn(), f)
+		}
+		a.emit(ldB, uint32(l3+6))
+		protoChain(a, protos, t6, f)
+	}
+}
+
+// nextInsn returns a label for the instruction after the one about to be emitted, i.e. falling through.
+func (a *assembler) nextInsn() int {
+	l := a.newLabel()
+	a.labels[l] = len(a.insns) + 1
+	return l
+}
+
+func protoChain(a *assembler, protos []uint32, t int, f int) {
+	for i, proto := range protos {
+		if i == len(protos)-1 {
+			a.cond(jeqK, proto, t, f)
+		} else {
+			a.cond(jeqK, proto, t, a.nextInsn())
+		}
+	}
+}
+
+func (n *protoNode) compile(a *assembler, t int, f int) {
+	ipProto(a, n.l3, n.ipv4, n.ipv6, []uint32{n.proto}, t, t, f)
+}
+
+func (n *portNode) compile(a *assembler, t int, f int) {
+
+	p4 := a.newLabel()
+	p6 := a.newLabel()
+
+	ipProto(a, n.l3, true, true, n.protos, p4, p6, f)
+
+	// IPv4: skip fragments, then index past the variable-length header.
+	a.place(p4)
+	a.emit(ldH, uint32(n.l3+6))
+	a.cond(jsetK, ipv4FragmentMask, f, a.nextInsn())
+	a.emit(ldxMsh, uint32(n.l3))
+	portChecks(a, ldIndH, uint32(n.l3), n.direction, n.port, t, f)
+
+	a.place(p6)
+	portChecks(a, ldH, uint32(n.l3+ipv6HeaderLength), n.direction, n.port, t, f)
+}
+
+func portChecks(a *assembler, load uint16, offset uint32, direction int, port uint32, t int, f int) {
+	switch direction {
+	case directionSource:
+		a.emit(load, offset)
+		a.cond(jeqK, port, t, f)
+	case directionDestination:
+		a.emit(load, offset+2)
+		a.cond(jeqK, port, t, f)
+	default:
+		a.emit(load, offset)
+		a.cond(jeqK, port, t, a.nextInsn())
+		a.emit(load, offset+2)
+		a.cond(jeqK, port, t, f)
+	}
+}
+
+func (n *hostNode) compile(a *assembler, t int, f int) {
+	a.emit(ldH, uint32(n.l3-2))
+	a.cond(jeqK, etherTypeIPv4, a.nextInsn(), f)
+
+	switch n.direction {
+	case directionSource:
+		a.emit(ldW, uint32(n.l3+12))
+		a.cond(jeqK, n.ip, t, f)
+	case directionDestination:
+		a.emit(ldW, uint32(n.l3+16))
+		a.cond(jeqK, n.ip, t, f)
+	default:
+		a.emit(ldW, uint32(n.l3+12))
+		a.cond(jeqK, n.ip, t, a.nextInsn())
+		a.emit(ldW, uint32(n.l3+16))
+		a.cond(jeqK, n.ip, t, f)
+	}
+}
+
+func (n *etherHostNode) compile(a *assembler, t int, f int) {
+
+	high := uint32(n.mac[0])<<8 | uint32(n.mac[1])
+	low := uint32(n.mac[2])<<24 | uint32(n.mac[3])<<16 | uint32(n.mac[4])<<8 | uint32(n.mac[5])
+
+	check := func(offset uint32, t int, f int) {
+		a.emit(ldW, offset+2)
+		a.cond(jeqK, low, a.nextInsn(), f)
+		a.emit(ldH, offset)
+		a.cond(jeqK, high, t, f)
+	}
+
+	switch n.direction {
+	case directionSource:
+		check(6, t, f)
+	case directionDestination:
+		check(0, t, f)
+	default:
+		m := a.newLabel()
+		check(6, t, m)
+		a.place(m)
+		check(0, t, f)
+	}
+}
+
+func (n *vlanNode) compile(a *assembler, t int, f int) {
+
+	inline := a.newLabel()
+
+	if !n.inlineOnly {
+		stripped := a.newLabel()
+
+		// Tag already stripped by the kernel?
+		a.emit(ldW, skfAdOff+skfAdVlanTagPresent)
+		a.cond(jeqK, 1, stripped, inline)
+
+		a.place(stripped)
+
+		if n.id >= 0 {
+			a.emit(ldW, skfAdOff+skfAdVlanTag)
+			a.emit(andK, vlanIDMask)
+			a.cond(jeqK, uint32(n.id), a.nextInsn(), f)
+		}
+
+		n.restStripped.compile(a, t, f)
+	}
+
+	// Otherwise look for it in the frame.
+	a.place(inline)
+
+	tagged := a.newLabel()
+
+	a.emit(ldH, uint32(n.l3-2))
+	a.cond(jeqK, etherTypeVLAN, tagged, a.nextInsn())
+	a.cond(jeqK, etherTypeQinQ, tagged, f)
+
+	a.place(tagged)
+
+	if n.id >= 0 {
+		a.emit(ldH, uint32(n.l3))
+		a.emit(andK, vlanIDMask)
+		a.cond(jeqK, uint32(n.id), a.nextInsn(), f)
+	}
+
+	n.restInline.compile(a, t, f)
+}
+
+// Compile turns a filter expression into a classic BPF program for SO_ATTACH_FILTER.
+func Compile(expr string) ([]unix.SockFilter, error) {
+
+	p := &parser{tokens: tokenize(expr)}
+
+	root, err := p.parseOr(baseL3Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) {
+		return nil, errors.New("Unexpected " + p.peek() + " in filter expression")
+	}
+
+	a := &assembler{}
+	accept := a.newLabel()
+	reject := a.newLabel()
+
+	root.compile(a, accept, reject)
+
+	a.place(accept)
+	a.emit(retK, snapLen)
+	a.place(reject)
+	a.emit(retK, 0)
+
+	return a.assemble()
+}
+
+// Dump prints a program the way tcpdump -d does, more or less.
+func Dump(prog []unix.SockFilter) string {
+
+	var b strings.Builder
+
+	for i, in := range prog {
+		fmt.Fprintf(&b, "(%03d) ", i)
+
+		switch in.Code {
+		case ldW, ldH, ldB:
+			size := map[uint16]string{ldW: "ld", ldH: "ldh", ldB: "ldb"}[in.Code]
+			if in.K >= skfAdOff {
+				fmt.Fprintf(&b, "%-8s%s\n", size, map[uint32]string{skfAdVlanTag: "vlan_tci", skfAdVlanTagPresent: "vlan_avail"}[in.K-skfAdOff])
+			} else {
+				fmt.Fprintf(&b, "%-8s[%d]\n", size, in.K)
+			}
+		case ldIndH:
+			fmt.Fprintf(&b, "%-8s[x + %d]\n", "ldh", in.K)
+		case ldxMsh:
+			fmt.Fprintf(&b, "%-8s4*([%d]&0xf)\n", "ldxb", in.K)
+		case andK:
+			fmt.Fprintf(&b, "%-8s#0x%x\n", "and", in.K)
+		case jeqK, jsetK:
+			op := map[uint16]string{jeqK: "jeq", jsetK: "jset"}[in.Code]
+			fmt.Fprintf(&b, "%-8s#0x%-14x jt %d\tjf %d\n", op, in.K, i+1+int(in.Jt), i+1+int(in.Jf))
+		case ja:
+			fmt.Fprintf(&b, "%-8s%d\n", "ja", i+1+int(in.K))
+		case retK:
+			fmt.Fprintf(&b, "%-8s#%d\n", "ret", in.K)
+		default:
+			fmt.Fprintf(&b, "0x%02x %d %d 0x%08x\n", in.Code, in.Jt, in.Jf, in.K)
+		}
+	}
+
+	return b.String()
+}
+
+// ForDhcpV4 gives the expression for what a dhcpv4 run needs to see: replies to the client port, or to the server port
+// when relaying, plus ARP if we're answering it, all inside the clients' VLAN tags if they have any.
+func ForDhcpV4(o *config.DhcpV4Options) string {
+
+	expr := "udp dst port 68"
+
+	if o.DhcpRelay {
+		expr = "udp dst port 67"
+	}
+
+	if o.Arp {
+		expr = "arp or " + expr
+	}
+
+	if o.Vlans != nil {
+		expr = "(" + expr + ")"
+
+		for i := 0; i < o.Vlans.Depth(); i++ {
+			expr = "vlan and " + expr
+		}
+	}
+
+	return expr
+}
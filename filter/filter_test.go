@@ -0,0 +1,193 @@
+package filter
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/vlan"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+)
+
+// run is just enough of a classic BPF interpreter for what Compile emits.  vlan is the tag the kernel would have
+// stripped into metadata, or -1.
+func run(t *testing.T, prog []unix.SockFilter, pkt []byte, vlan int) uint32 {
+	var a, x uint32
+
+	load := func(off uint32, size int) uint32 {
+		if int(off)+size > len(pkt) {
+			return 0
+		}
+		switch size {
+		case 4:
+			return binary.BigEndian.Uint32(pkt[off:])
+		case 2:
+			return uint32(binary.BigEndian.Uint16(pkt[off:]))
+		}
+		return uint32(pkt[off])
+	}
+
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+
+		switch in.Code {
+		case ldW:
+			switch in.K {
+			case skfAdOff + skfAdVlanTagPresent:
+				a = 0
+				if vlan >= 0 {
+					a = 1
+				}
+			case skfAdOff + skfAdVlanTag:
+				a = uint32(vlan)
+			default:
+				a = load(in.K, 4)
+			}
+		case ldH:
+			a = load(in.K, 2)
+		case ldB:
+			a = load(in.K, 1)
+		case ldIndH:
+			a = load(x+in.K, 2)
+		case ldxMsh:
+			x = 4 * (load(in.K, 1) & 0xf)
+		case andK:
+			a &= in.K
+		case ja:
+			pc += int(in.K)
+		case jeqK:
+			if a == in.K {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case jsetK:
+			if a&in.K != 0 {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case retK:
+			return in.K
+		default:
+			t.Fatalf("Unexpected instruction 0x%x at %d", in.Code, pc)
+		}
+	}
+
+	t.Fatal("Program fell off the end")
+	return 0
+}
+
+func frame(t *testing.T, vlan int, l ...gopacket.SerializableLayer) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	if _, ok := l[0].(*layers.ARP); ok {
+		eth.EthernetType = layers.EthernetTypeARP
+	}
+
+	all := []gopacket.SerializableLayer{eth}
+
+	if vlan >= 0 {
+		all = append(all, &layers.Dot1Q{VLANIdentifier: uint16(vlan), Type: eth.EthernetType})
+		eth.EthernetType = layers.EthernetTypeDot1Q
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, append(all, l...)...); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func udp(srcPort, dstPort int) []gopacket.SerializableLayer {
+	return []gopacket.SerializableLayer{
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)},
+		&layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)},
+		gopacket.Payload([]byte{1, 2, 3, 4}),
+	}
+}
+
+func TestCompile(t *testing.T) {
+
+	reply := frame(t, -1, udp(67, 68)...)
+	request := frame(t, -1, udp(68, 67)...)
+	arp := frame(t, -1, &layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+		SourceHwAddress: []byte{0, 1, 2, 3, 4, 5}, SourceProtAddress: []byte{10, 0, 0, 1}, DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 0, 0, 2}})
+	taggedReply := frame(t, 10, udp(67, 68)...)
+	qinqReply := frame(t, 5, udp(67, 68)...) // The outer tag has been stripped by the kernel.
+
+	tests := []struct {
+		expr    string
+		pkt     []byte
+		vlan    int
+		matches bool
+	}{
+		{"arp or udp dst port 68", reply, -1, true},
+		{"arp or udp dst port 68", request, -1, false},
+		{"arp or udp dst port 68", arp, -1, true},
+		{"udp dst port 68", arp, -1, false},
+		{"port 67", request, -1, true},
+		{"udp src port 68 and not arp", request, -1, true},
+		{"tcp port 67", request, -1, false},
+		{"src host 10.0.0.1 && !(dst host 10.0.0.1)", request, -1, true},
+		{"dst host 10.0.0.1", request, -1, false},
+		{"ether src host 00:01:02:03:04:05", request, -1, true},
+		{"ether dst host 00:01:02:03:04:05", request, -1, false},
+		{"icmp or ip6", request, -1, false},
+		{"udp dst port 68", taggedReply, -1, false},
+		{"vlan and udp dst port 68", taggedReply, -1, true},
+		{"vlan 10 and udp dst port 68", taggedReply, -1, true},
+		{"vlan 11 and udp dst port 68", taggedReply, -1, false},
+		{"vlan 10 and udp dst port 68", reply, 10, true},
+		{"vlan 10 and udp dst port 68", reply, 11, false},
+		{"vlan 10 and udp dst port 68", reply, -1, false},
+		{"vlan and vlan and udp dst port 68", qinqReply, 100, true},
+		{"vlan and vlan and udp dst port 68", reply, 100, false},
+		{"vlan and vlan and udp dst port 68", qinqReply, -1, false},
+		{"vlan 100 and vlan 5 and udp dst port 68", qinqReply, 100, true},
+		{"vlan 100 and vlan 6 and udp dst port 68", qinqReply, 100, false},
+	}
+
+	for _, test := range tests {
+		prog, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+
+		if matched := run(t, prog, test.pkt, test.vlan) != 0; matched != test.matches {
+			t.Errorf("%s (vlan %d): matched == %v, expected %v\n%s", test.expr, test.vlan, matched, test.matches, Dump(prog))
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{"", "udp port", "port 70000", "(arp", "arp udp", "host fe80::1", "vlan 5000", "bogus"} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestForDhcpV4(t *testing.T) {
+	if expr := ForDhcpV4(&config.DhcpV4Options{}); expr != "udp dst port 68" {
+		t.Errorf("Unexpected expression: %s", expr)
+	}
+
+	if expr := ForDhcpV4(&config.DhcpV4Options{DhcpRelay: true, Arp: true}); expr != "arp or udp dst port 67" {
+		t.Errorf("Unexpected expression: %s", expr)
+	}
+
+	plan, _ := vlan.NewPlan(layers.EthernetTypeQinQ, []uint16{100}, []uint16{1})
+
+	if expr := ForDhcpV4(&config.DhcpV4Options{Vlans: plan}); expr != "vlan and vlan and (udp dst port 68)" {
+		t.Errorf("Unexpected expression: %s", expr)
+	}
+}
@@ -0,0 +1,126 @@
+package generator
+
+import (
+	"github.com/ipchama/dhammer/pacer"
+	"math/rand"
+	"time"
+)
+
+/*
+	Closed loop:  A fixed number of virtual clients, each starting its next transaction only once its last one is over,
+	plus ThinkTime.  How fast that goes is up to the server, so throughput is what gets measured instead of what gets
+	asked for.  The pacer still caps it if there's a rate.
+
+	A transaction is over when the handler says so, or when it times out, which frees the client all the same.
+	A DISCOVER that can't be sent is tried again after a wait that doubles up to expireInterval, so a transport that
+	keeps failing doesn't have the loop spinning on it.
+*/
+
+const (
+	expireInterval = 100 * time.Millisecond
+	minRetryWait   = time.Millisecond
+)
+
+// TransactionMsBuckets are the histogram bounds for how long transactions took, in milliseconds.
+var TransactionMsBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// Never blocks in a select, for when there's more to send right away.
+var immediately = func() chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+func (g *GeneratorV4) runClosedLoop(pace *pacer.Pacer, timer *time.Timer, start time.Time, nRand *rand.Rand, send func(uint32) bool) {
+
+	tracker := g.options.Transactions
+
+	completed := g.registry.Counter("TransactionsCompleted")
+	timeouts := g.registry.Counter("TransactionTimeouts")
+	durations := g.registry.Histogram("TransactionMs", TransactionMsBuckets)
+	inFlight := g.registry.Gauge("TransactionsInFlight")
+
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	idle := g.options.Concurrency // Clients ready to start a transaction.
+	var thinking []time.Time      // When each thinking client is ready, earliest first.
+	var retryAt time.Time         // Don't try sending again before this after a failed send.
+	retryWait := minRetryWait
+
+	over := func(now time.Time) {
+		if g.options.ThinkTime > 0 {
+			thinking = append(thinking, now.Add(g.options.ThinkTime))
+		} else {
+			idle++
+		}
+	}
+
+	for g.options.MaxLifetime == 0 || int(time.Since(start).Seconds()) <= g.options.MaxLifetime {
+
+		now := time.Now()
+
+		for len(thinking) > 0 && !thinking[0].After(now) {
+			thinking = thinking[1:]
+			idle++
+		}
+
+		var wake <-chan time.Time // nil == nothing to do until a transaction's over.
+		timerSet := false
+
+		if idle > 0 && now.Before(retryAt) {
+			timer.Reset(retryAt.Sub(now))
+			wake, timerSet = timer.C, true
+		} else if idle > 0 {
+			if wait := pace.Take(now); wait > 0 {
+				timer.Reset(wait)
+				wake, timerSet = timer.C, true
+			} else {
+				xid := nRand.Uint32()
+				tracker.Start(xid, now)
+
+				if send(xid) {
+					idle--
+					retryWait = minRetryWait
+				} else {
+					tracker.Abandon(xid)
+					retryAt = now.Add(retryWait)
+
+					if retryWait *= 2; retryWait > expireInterval {
+						retryWait = expireInterval
+					}
+				}
+
+				wake = immediately
+			}
+		} else if len(thinking) > 0 {
+			timer.Reset(thinking[0].Sub(now))
+			wake, timerSet = timer.C, true
+		}
+
+		select {
+		case <-g.finishChannel:
+			return
+		case rps := <-g.rpsChannel:
+			pace.SetRate(rps, time.Now())
+		case r := <-tracker.Finished():
+			completed.Inc()
+			completed.IncBy("result", r.Outcome)
+			durations.Observe(float64(r.Duration) / float64(time.Millisecond))
+			over(time.Now())
+		case now := <-ticker.C:
+			inFlight.Set(float64(tracker.InFlight()))
+
+			for n := tracker.Expire(now); n > 0; n-- {
+				timeouts.Inc()
+				over(now)
+			}
+		case <-wake:
+			timerSet = false
+		}
+
+		if timerSet && !timer.Stop() {
+			<-timer.C
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package generator
+
+import (
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/pacer"
+	"github.com/ipchama/dhammer/stats"
+	"github.com/ipchama/dhammer/transaction"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestClosedLoopBacksOffFailedSends(t *testing.T) {
+
+	options := &config.DhcpV4Options{
+		Concurrency:  1,
+		Transactions: transaction.NewTracker(1, time.Second),
+	}
+
+	registry := stats.NewRegistry()
+
+	g := &GeneratorV4{
+		options:       options,
+		registry:      registry,
+		finishChannel: make(chan struct{}, 1),
+		rpsChannel:    make(chan int, 1),
+	}
+
+	timer := time.NewTimer(time.Hour)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	attempts := 0
+	done := make(chan struct{})
+
+	go func() {
+		g.runClosedLoop(pacer.New(0, 0, registry, time.Now()), timer, time.Now(), rand.New(rand.NewSource(1)), func(uint32) bool {
+			attempts++
+			return false
+		})
+		close(done)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	g.finishChannel <- struct{}{}
+	<-done
+
+	// 1, 2, 4 ... 64ms and then every 100ms comes to about 10 tries in half a second.
+	if attempts < 2 || attempts > 20 {
+		t.Errorf("Expected failed sends to back off, got %d attempts in 500ms", attempts)
+	}
+}
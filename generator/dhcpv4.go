@@ -3,27 +3,31 @@ package generator
 import (
 	"encoding/base64"
 	"fmt"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/pacer"
+	"github.com/ipchama/dhammer/packet"
 	"github.com/ipchama/dhammer/socketeer"
 	"github.com/ipchama/dhammer/stats"
+	"github.com/ipchama/dhammer/vlan"
 	"math/rand"
 	"net"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const profileInterval = 100 * time.Millisecond
+
 type GeneratorV4 struct {
 	options       *config.DhcpV4Options
-	socketeer     *socketeer.RawSocketeer
+	socketeer     socketeer.Transport
 	iface         *net.Interface
 	addLog        func(string) bool
 	addError      func(error) bool
 	sendPayload   func([]byte) bool
-	addStat       func(stats.StatValue) bool
+	registry      *stats.Registry
+	discoverSent  *stats.Counter
 	finishChannel chan struct{}
 	doneChannel   chan struct{}
 	rpsChannel    chan int
@@ -40,11 +44,11 @@ func NewDhcpV4(gip GeneratorInitParams) Generator {
 	g := GeneratorV4{
 		options:       gip.options.(*config.DhcpV4Options),
 		socketeer:     gip.socketeer,
-		iface:         gip.socketeer.IfInfo,
+		iface:         gip.socketeer.InterfaceInfo(),
 		addLog:        gip.logFunc,
 		addError:      gip.errFunc,
 		sendPayload:   gip.socketeer.AddPayload,
-		addStat:       gip.statFunc,
+		registry:      gip.registry,
 		finishChannel: make(chan struct{}, 1),
 		doneChannel:   make(chan struct{}),
 		rpsChannel:    make(chan int, 1),
@@ -54,6 +58,7 @@ func NewDhcpV4(gip GeneratorInitParams) Generator {
 }
 
 func (g *GeneratorV4) Init() error {
+	g.discoverSent = g.registry.Counter("DiscoverSent")
 	return nil
 }
 
@@ -62,8 +67,12 @@ func (g *GeneratorV4) DeInit() error {
 }
 
 func (g *GeneratorV4) Stop() error {
-	g.finishChannel <- struct{}{}
-	<-g.doneChannel
+	select {
+	case g.finishChannel <- struct{}{}:
+	default:
+	}
+
+	<-g.doneChannel // Closed whenever Run returns, even if it got there first.
 	return nil
 }
 
@@ -81,20 +90,22 @@ func (g *GeneratorV4) Update(details interface{}) error {
 
 func (g *GeneratorV4) Run() {
 
+	defer close(g.doneChannel)
+
 	macs := g.generateMacList()
+	stacks, stackNames := g.assignVlans(macs)
 	nS := rand.NewSource(time.Now().Unix())
 	nRand := rand.New(nS)
 
 	socketeerOptions := g.socketeer.Options()
 
-	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-
 	outDhcpLayer := &layers.DHCPv4{
 		Operation:    layers.DHCPOpRequest,
 		HardwareType: layers.LinkTypeEthernet,
 		HardwareLen:  6,
 		//HardwareOpts // Used by relay agents
-		Flags: 0x8000, // Broadcast
+		Flags:        0x8000,                    // Broadcast
+		ClientHWAddr: make(net.HardwareAddr, 6), // Patched per client, but FixLengths takes HardwareLen from it.
 	}
 
 	if !g.options.DhcpBroadcast {
@@ -172,79 +183,206 @@ func (g *GeneratorV4) Run() {
 		udpLayer.SrcPort = 67
 	}
 
+	// I refuse to even assign to _ ...
+	// skipcq
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	// Every DISCOVER is the same apart from the xid, chaddr and VLAN IDs, so they're patched into copies of a template.
+	template, err := packet.NewTemplate(stacks[0].Wrap(ethernetLayer, layers.EthernetTypeIPv4,
+		ipLayer,
+		udpLayer,
+		outDhcpLayer,
+	)...)
+
+	if err != nil {
+		g.addError(err)
+		<-g.finishChannel
+		return
+	}
+
 	i := 0 // Increment later
 
-	sent := 0
+	// send sends the next client's DISCOVER with the given xid and moves on to the client after it.
+	send := func(xid uint32) bool {
+
+		frame := template.Frame()
+
+		if g.options.ClientSourceMAC {
+			template.SetSrcMAC(frame, macs[i])
+		}
+
+		template.SetVlans(frame, stacks[i])
+		template.SetXid(frame, xid)
+		template.SetChaddr(frame, macs[i])
+
+		sent := g.sendPayload(frame)
+
+		if sent {
+			g.discoverSent.Inc()
+
+			if stackNames != nil {
+				g.discoverSent.IncBy("vlan", stackNames[i])
+			}
+		}
+
+		if i++; i > len(macs)-1 {
+			i = 0
+		}
+
+		return sent
+	}
+
+	pace := pacer.New(g.options.RequestsPerSecond, g.options.Burst, g.registry, time.Now())
+
+	if g.options.DryRun { // Nothing goes on the wire in a dry run, so there's nothing to pace.
+		pace.SetRate(0, time.Now())
+	}
+
+	if g.options.PoissonArrivals {
+		pace.Poisson(nRand, time.Now())
+	}
+
+	// Stopped and drained, ready for Reset.
+	timer := time.NewTimer(time.Hour)
+	if !timer.Stop() {
+		<-timer.C
+	}
 
 	start := time.Now()
-	time.Sleep(1 * time.Nanosecond)
 
-	mRps := g.options.RequestsPerSecond
+	/*
+		With a profile, the rate is looked up every profileInterval and only handed to the pacer when it changes, so
+		an /update holds until the profile moves on.  The pacer takes 0 to mean unlimited, but a profile at 0 means
+		nothing should go out at all, so that's handled here as a pause.
+	*/
+	var profileTick <-chan time.Time
+	var profilePhase *stats.Info
+	profileRate := -1
+	paused := false
+
+	followProfile := func(now time.Time) bool {
+		rate, phase, done := g.options.Profile.At(now.Sub(start))
+		if done {
+			g.addLog("Load profile finished.")
+			return false
+		}
+
+		if phase != profilePhase.Value() {
+			profilePhase.Set(phase)
+			g.addLog("Load profile phase: " + phase)
+		}
 
-	var t time.Time
-	var elapsed float64
-	var rps int
+		if rate != profileRate {
+			profileRate = rate
+			paused = rate == 0
+			pace.SetRate(rate, now)
+		}
+
+		return true
+	}
+
+	if g.options.Profile != nil {
+		ticker := time.NewTicker(profileInterval)
+		defer ticker.Stop()
+
+		profileTick = ticker.C
+		profilePhase = g.registry.Info("ProfilePhase", "phase")
+
+		if !followProfile(start) {
+			return
+		}
+	}
 
-	var err error
 	g.addLog("Finished generating MACs and preparing packet headers.")
 
-	for g.options.MaxLifetime == 0 || int(elapsed) <= g.options.MaxLifetime {
+	if g.options.Transactions != nil {
+		g.runClosedLoop(pace, timer, start, nRand, send)
+		return
+	}
+
+	for g.options.MaxLifetime == 0 || int(time.Since(start).Seconds()) <= g.options.MaxLifetime {
 
 		select {
 		case <-g.finishChannel:
-			close(g.doneChannel)
 			return
+		case rps := <-g.rpsChannel:
+			paused = false
+			pace.SetRate(rps, time.Now())
+		case now := <-profileTick:
+			if !followProfile(now) {
+				return
+			}
 		default:
 		}
 
-		select {
-		case mRps = <-g.rpsChannel:
-			sent = 0
-			start = time.Now()
-			time.Sleep(1 * time.Nanosecond) // Being explict...
-		default:
+		if paused {
+			select {
+			case <-g.finishChannel:
+				return
+			case rps := <-g.rpsChannel:
+				paused = false
+				pace.SetRate(rps, time.Now())
+			case now := <-profileTick:
+				if !followProfile(now) {
+					return
+				}
+			}
+
+			continue
 		}
 
-		t = time.Now()
-		elapsed = t.Sub(start).Seconds()
-		rps = int(float64(sent) / elapsed)
+		if wait := pace.Take(time.Now()); wait > 0 {
+			timer.Reset(wait)
+
+			select {
+			case <-g.finishChannel:
+				return
+			case rps := <-g.rpsChannel:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				paused = false
+				pace.SetRate(rps, time.Now())
+			case now := <-profileTick:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				if !followProfile(now) {
+					return
+				}
+			case <-timer.C:
+			}
 
-		if rps >= mRps {
-			runtime.Gosched()
 			continue
 		}
 
-		outDhcpLayer.Xid = nRand.Uint32()
-		outDhcpLayer.ClientHWAddr = macs[i]
+		send(nRand.Uint32())
 
-		//ethernetLayer.SrcMAC = macs[i]
+		if i == 0 && g.options.DryRun {
+			g.addLog("Dry run: sent one DISCOVER for each MAC.")
+			return
+		}
+	}
 
-		// I refuse to even assign to _ ...
-		// skipcq
-		udpLayer.SetNetworkLayerForChecksum(ipLayer)
+}
 
-		buf := gopacket.NewSerializeBuffer()
-		if err = gopacket.SerializeLayers(buf, opts,
-			ethernetLayer,
-			ipLayer,
-			udpLayer,
-			outDhcpLayer,
-		); err != nil {
-			g.addError(err)
-			continue
-		}
+// assignVlans gives each MAC its VLAN tags up front, in MAC order, so clients are spread evenly across the VLANs.
+func (g *GeneratorV4) assignVlans(macs []net.HardwareAddr) ([]vlan.Stack, []string) {
 
-		if g.sendPayload(buf.Bytes()) {
-			g.addStat(stats.DiscoverSentStat)
-		}
+	stacks := make([]vlan.Stack, len(macs))
 
-		sent++
+	if g.options.Vlans == nil {
+		return stacks, nil
+	}
 
-		if i++; i > len(macs)-1 {
-			i = 0
-		}
+	names := make([]string, len(macs))
+
+	for i, mac := range macs {
+		stacks[i] = g.options.Vlans.Assign(mac)
+		names[i] = stacks[i].String()
 	}
 
+	return stacks, names
 }
 
 func (g *GeneratorV4) generateMacList() []net.HardwareAddr {
@@ -263,9 +401,18 @@ func (g *GeneratorV4) generateMacList() []net.HardwareAddr {
 	padMacCount := g.options.MacCount - len(g.options.SpecifiedMacs)
 
 	for i := 0; i < padMacCount; i++ {
-		// Have to play bit-shift games to make sure the first bit in the first octet (broadcast bit) in the MAC is 0 or this will look like a multicast address.
-		// Technically, should also be setting the second bit, but things will work either way.
-		macs = append(macs, net.HardwareAddr{byte(nRand.Intn(256) & (^(1 << 8))), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256))})
+		mac := net.HardwareAddr{byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256))}
+
+		/*
+			Frames sent from these MACs need the first octet's lowest bit at 0, or it's a multicast address, which
+			switches won't take as a source.  The next bit up marks it as locally administered, so it can't clash with a
+			real vendor's MACs.  Only done when it matters, so a --mac-seed gives the same list it always has otherwise.
+		*/
+		if g.options.ClientSourceMAC {
+			mac[0] = mac[0]&^0x01 | 0x02
+		}
+
+		macs = append(macs, mac)
 	}
 
 	for _, m := range g.options.SpecifiedMacs {
@@ -276,5 +423,10 @@ func (g *GeneratorV4) generateMacList() []net.HardwareAddr {
 		}
 	}
 
+	// Every interface generates the same list from the same seed and takes its own slice of it.
+	if g.options.MacPartitions > 1 {
+		macs = macs[len(macs)*g.options.MacPartition/g.options.MacPartitions : len(macs)*(g.options.MacPartition+1)/g.options.MacPartitions]
+	}
+
 	return macs
 }
@@ -0,0 +1,56 @@
+package generator
+
+import (
+	"github.com/ipchama/dhammer/config"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestGenerateMacList(t *testing.T) {
+
+	options := &config.DhcpV4Options{MacCount: 1000, MacSeed: 42}
+	g := &GeneratorV4{options: options, addError: func(error) bool { return true }}
+
+	all := g.generateMacList()
+
+	// The same seed has to give the same MACs as it always has.
+	nRand := rand.New(rand.NewSource(42))
+	first := net.HardwareAddr{byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256)), byte(nRand.Intn(256))}
+
+	if all[0].String() != first.String() {
+		t.Errorf("Seed 42 starts with %s, expected %s", all[0], first)
+	}
+
+	sourceOptions := *options
+	sourceOptions.ClientSourceMAC = true
+	g.options = &sourceOptions
+
+	for _, mac := range g.generateMacList() {
+		if mac[0]&0x01 != 0 || mac[0]&0x02 == 0 {
+			t.Fatalf("%s isn't a locally administered unicast MAC", mac)
+		}
+	}
+
+	// Interfaces each take their share of the same list.
+	seen := make(map[string]bool)
+
+	for p := 0; p < 3; p++ {
+		partOptions := *options
+		partOptions.MacPartition = p
+		partOptions.MacPartitions = 3
+
+		g.options = &partOptions
+
+		for _, mac := range g.generateMacList() {
+			if seen[mac.String()] {
+				t.Fatalf("%s is in more than one partition", mac)
+			}
+			seen[mac.String()] = true
+		}
+	}
+
+	if len(seen) != len(all) {
+		t.Errorf("Partitions have %d MACs between them out of %d", len(seen), len(all))
+	}
+}
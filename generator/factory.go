@@ -16,11 +16,11 @@ type Generator interface {
 }
 
 type GeneratorInitParams struct {
-	socketeer *socketeer.RawSocketeer
+	socketeer socketeer.Transport
 	options   config.HammerConfig
 	logFunc   func(string) bool
 	errFunc   func(error) bool
-	statFunc  func(stats.StatValue) bool
+	registry  *stats.Registry
 }
 
 var generators map[string]func(GeneratorInitParams) Generator = make(map[string]func(GeneratorInitParams) Generator)
@@ -35,14 +35,14 @@ func AddGenerator(s string, f func(GeneratorInitParams) Generator) error {
 	return nil
 }
 
-func New(s *socketeer.RawSocketeer, o config.HammerConfig, logFunc func(string) bool, errFunc func(error) bool, statFunc func(stats.StatValue) bool) (Generator, error) {
+func New(s socketeer.Transport, o config.HammerConfig, logFunc func(string) bool, errFunc func(error) bool, r *stats.Registry) (Generator, error) {
 
 	gip := GeneratorInitParams{
 		socketeer: s,
 		options:   o,
 		logFunc:   logFunc,
 		errFunc:   errFunc,
-		statFunc:  statFunc,
+		registry:  r,
 	}
 
 	gf, ok := generators[o.HammerType()]
@@ -42,7 +42,7 @@ func TestNew(t *testing.T) {
 		hType: "__TEST__",
 	}
 
-	if _, err := generator.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, func(stats.StatValue) bool { return true }); err == nil {
+	if _, err := generator.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err == nil {
 		t.Errorf("Generator factory did not return error for unknown type.")
 	}
 
@@ -54,7 +54,7 @@ func TestNew(t *testing.T) {
 		t.Errorf("Generator factory allowed duplicate type.")
 	}
 
-	if _, err := generator.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, func(stats.StatValue) bool { return true }); err != nil {
+	if _, err := generator.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err != nil {
 		t.Errorf("Generator factory failed to return known type.")
 	}
 
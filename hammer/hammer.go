@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -26,34 +28,71 @@ import (
 		Option structs should stop being references.
 */
 
-type Hammer struct {
-	options          config.HammerConfig
-	socketeerOptions *config.SocketeerOptions
-	logChannel       chan string
-	statsChannel     chan string
-	errorChannel     chan error
+/*
+	Each interface gets a lane of its own:  a socketeer, generator and handler, with its own options, just like a
+	separate dhammer process would have.  Stats are shared, and with more than one interface they're also broken
+	down by an "interface" label.
+*/
 
+// Interface is the configuration for one interface's lane.
+type Interface struct {
+	Options          config.HammerConfig
+	SocketeerOptions *config.SocketeerOptions
+}
+
+type lane struct {
+	Interface
+	name      string
 	handler   handler.Handler
 	generator generator.Generator
-	stats     stats.Stats
-	socketeer *socketeer.RawSocketeer
+	socketeer socketeer.Transport
+}
+
+type Hammer struct {
+	options      config.HammerConfig
+	logChannel   chan string
+	statsChannel chan string
+	errorChannel chan error
+
+	lanes []*lane
+	stats stats.Stats
 
 	apiServer *httpway.Server
 }
 
-func New(s *config.SocketeerOptions, o config.HammerConfig) *Hammer {
+// New takes the run-wide options, used for stats, and one Interface for each interface.
+func New(o config.HammerConfig, interfaces []Interface) *Hammer {
 
 	h := Hammer{
-		socketeerOptions: s,
-		options:          o,
-		logChannel:       make(chan string, 1000),
-		statsChannel:     make(chan string, 1000),
-		errorChannel:     make(chan error, 1000),
+		options:      o,
+		logChannel:   make(chan string, 1000),
+		statsChannel: make(chan string, 1000),
+		errorChannel: make(chan error, 1000),
+	}
+
+	for _, i := range interfaces {
+		name := i.SocketeerOptions.InterfaceName
+
+		// Namespaces can each have their own eth0.
+		if i.SocketeerOptions.Netns != "" {
+			name = i.SocketeerOptions.Netns + ":" + name
+		}
+
+		h.lanes = append(h.lanes, &lane{Interface: i, name: name})
 	}
 
 	return &h
 }
 
+// describe adds the interface to a log message when there's more than one.
+func (h *Hammer) describe(msg string, l *lane) string {
+	if len(h.lanes) > 1 {
+		return msg + " on " + l.name + "."
+	}
+
+	return msg + "."
+}
+
 func (h *Hammer) Init(apiAddr string, apiPort int) error {
 
 	var err error
@@ -68,30 +107,53 @@ func (h *Hammer) Init(apiAddr string, apiPort int) error {
 		return err
 	}
 
-	h.socketeer = socketeer.NewRawSocketeer(h.socketeerOptions, h.addLog, h.addError)
-	if err = h.socketeer.Init(); err != nil {
+	for _, l := range h.lanes {
+		if err = h.initLane(l); err != nil {
+			return err
+		}
+	}
+
+	if apiPort != 0 {
+		h.initApiServer(apiAddr, apiPort)
+	}
+
+	return nil
+}
+
+func (h *Hammer) initLane(l *lane) error {
+
+	var err error
+
+	registry := h.stats.Registry()
+	if len(h.lanes) > 1 {
+		registry = registry.Scoped("interface", l.name)
+	}
+
+	if l.socketeer, err = socketeer.New(l.SocketeerOptions, h.addLog, h.addError, registry); err != nil {
 		return err
 	}
 
-	if h.handler, err = handler.New(h.socketeer, h.options, h.addLog, h.addError, h.stats.AddStat); err != nil {
+	if err = l.socketeer.Init(); err != nil {
 		return err
 	}
 
-	if err := h.handler.Init(); err != nil {
+	if l.generator, err = generator.New(l.socketeer, l.Options, h.addLog, h.addError, registry); err != nil {
 		return err
 	}
 
-	h.socketeer.SetReceiver(h.handler.ReceiveMessage)
+	if err = l.generator.Init(); err != nil {
+		return err
+	}
 
-	if h.generator, err = generator.New(h.socketeer, h.options, h.addLog, h.addError, h.stats.AddStat); err != nil {
+	if l.handler, err = handler.New(l.socketeer, l.Options, h.addLog, h.addError, registry); err != nil {
 		return err
 	}
 
-	if err = h.generator.Init(); err != nil {
+	if err := l.handler.Init(); err != nil {
 		return err
 	}
 
-	h.initApiServer(apiAddr, apiPort)
+	l.socketeer.SetReceiver(l.handler.ReceiveMessages)
 
 	return nil
 }
@@ -99,16 +161,18 @@ func (h *Hammer) Init(apiAddr string, apiPort int) error {
 func (h *Hammer) deInit() {
 	var err error
 
-	if err = h.socketeer.DeInit(); err != nil {
-		h.addError(err)
-	}
+	for _, l := range h.lanes {
+		if err = l.socketeer.DeInit(); err != nil {
+			h.addError(err)
+		}
 
-	if err = h.handler.DeInit(); err != nil {
-		h.addError(err)
-	}
+		if err = l.handler.DeInit(); err != nil {
+			h.addError(err)
+		}
 
-	if err = h.generator.DeInit(); err != nil {
-		h.addError(err)
+		if err = l.generator.DeInit(); err != nil {
+			h.addError(err)
+		}
 	}
 
 	if err = h.stats.DeInit(); err != nil {
@@ -139,29 +203,33 @@ func (h *Hammer) Run() error {
 		log.Print("INFO: Stopped stats.")
 	}()
 
-	log.Print("INFO: Starting writer.")
-	wg.Add(1)
-	go func() {
-		h.socketeer.RunWriter()
-		wg.Done()
-		log.Print("INFO: Stopped writer.")
-	}()
-
-	log.Print("INFO: Starting handler.")
-	wg.Add(1)
-	go func() {
-		h.handler.Run()
-		wg.Done()
-		log.Print("INFO: Stopped handler.")
-	}()
-
-	log.Print("INFO: Starting listener.")
-	wg.Add(1)
-	go func() {
-		h.socketeer.RunListener()
-		wg.Done()
-		log.Print("INFO: Stopped listener.")
-	}()
+	for _, l := range h.lanes {
+		l := l
+
+		log.Print(h.describe("INFO: Starting writer", l))
+		wg.Add(1)
+		go func() {
+			l.socketeer.RunWriter()
+			wg.Done()
+			log.Print(h.describe("INFO: Stopped writer", l))
+		}()
+
+		log.Print(h.describe("INFO: Starting handler", l))
+		wg.Add(1)
+		go func() {
+			l.handler.Run()
+			wg.Done()
+			log.Print(h.describe("INFO: Stopped handler", l))
+		}()
+
+		log.Print(h.describe("INFO: Starting listener", l))
+		wg.Add(1)
+		go func() {
+			l.socketeer.RunListener()
+			wg.Done()
+			log.Print(h.describe("INFO: Stopped listener", l))
+		}()
+	}
 
 	log.Print("INFO: Starting log channel reader.")
 	wg.Add(1)
@@ -187,19 +255,34 @@ func (h *Hammer) Run() error {
 		log.Print("INFO: Stopped stats channel reader.")
 	}()
 
-	log.Print("INFO: Starting generator.")
+	// Everything else stops once every generator has.
+	var generators sync.WaitGroup
+
+	for _, l := range h.lanes {
+		l := l
+
+		log.Print(h.describe("INFO: Starting generator", l))
+		generators.Add(1)
+		go func() {
+			l.generator.Run()
+			log.Print(h.describe("INFO: Stopped generator", l))
+			generators.Done()
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
-		h.generator.Run()
-		log.Print("INFO: Stopped generator.")
+		generators.Wait()
 		log.Print("INFO: Going to stop everything else...")
 		h.stop()
 		wg.Done()
 	}()
 
-	log.Print("INFO: Starting API server.")
-	h.startApiServer()
-	log.Print("INFO: Stopped API server.")
+	if h.apiServer != nil {
+		log.Print("INFO: Starting API server.")
+		h.startApiServer()
+		log.Print("INFO: Stopped API server.")
+	}
 
 	wg.Wait()
 
@@ -238,8 +321,10 @@ func (h *Hammer) addStats(s string) bool {
 func (h *Hammer) Stop() {
 	// All "stop" calls should block.
 	// This will make sure no new payloads go TO the writer FROM the generator.
-	if err := h.generator.Stop(); err != nil {
-		panic(err)
+	for _, l := range h.lanes {
+		if err := l.generator.Stop(); err != nil {
+			panic(err)
+		}
 	}
 }
 
@@ -252,16 +337,22 @@ func (h *Hammer) stop() {
 		h.addError(err)
 	}
 
-	if err = h.socketeer.StopListener(); err != nil { // This will make sure no new messages are sent TO the handler.
-		h.addError(err)
+	for _, l := range h.lanes {
+		if err = l.socketeer.StopListener(); err != nil { // This will make sure no new messages are sent TO the handler.
+			h.addError(err)
+		}
 	}
 
-	if err = h.handler.Stop(); err != nil { // This will make sure no new payloads go TO the writer FROM the handler.
-		h.addError(err)
+	for _, l := range h.lanes {
+		if err = l.handler.Stop(); err != nil { // This will make sure no new payloads go TO the writer FROM the handler.
+			h.addError(err)
+		}
 	}
 
-	if err = h.socketeer.StopWriter(); err != nil { // This will stop any writing to the underlying socket and stop any potential error or message logging.
-		h.addError(err)
+	for _, l := range h.lanes {
+		if err = l.socketeer.StopWriter(); err != nil { // This will stop any writing to the underlying socket and stop any potential error or message logging.
+			h.addError(err)
+		}
 	}
 
 	if err = h.stats.Stop(); err != nil { // This should be the last place that could send errors or logs.
@@ -288,6 +379,45 @@ func (h *Hammer) statsHandler(response http.ResponseWriter, request *http.Reques
 	fmt.Fprintf(response, h.stats.String())
 }
 
+func (h *Hammer) statsHistoryHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+
+	var since time.Time
+
+	if sinceParam := request.URL.Query().Get("since"); sinceParam != "" {
+		var err error
+
+		if since, err = parseTimestamp(sinceParam); err != nil {
+			h.addError(err)
+			http.Error(response, err.Error(), 400)
+			return
+		}
+	}
+
+	fmt.Fprintf(response, h.stats.History(since))
+}
+
+func (h *Hammer) statsResetHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+
+	if err := h.stats.Reset(); err != nil {
+		h.addError(err)
+		http.Error(response, err.Error(), 500)
+		return
+	}
+
+	fmt.Fprintf(response, "{\"status\": \"ok\"}")
+}
+
+// parseTimestamp accepts unix seconds, with or without a fraction, or RFC 3339.
+func parseTimestamp(ts string) (time.Time, error) {
+
+	if secs, err := strconv.ParseFloat(ts, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, ts)
+}
+
 func (h *Hammer) updateHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 
 	body, err := ioutil.ReadAll(request.Body)
@@ -308,10 +438,12 @@ func (h *Hammer) updateHandler(response http.ResponseWriter, request *http.Reque
 		return
 	}
 
-	if err := h.generator.Update(details); err != nil {
-		h.addError(err)
-		http.Error(response, err.Error(), 500)
-		return
+	for _, l := range h.lanes {
+		if err := l.generator.Update(details); err != nil {
+			h.addError(err)
+			http.Error(response, err.Error(), 500)
+			return
+		}
 	}
 
 	fmt.Fprintf(response, "{\"status\": \"ok\"}")
@@ -324,6 +456,16 @@ func (h *Hammer) initApiServer(apiAddr string, apiPort int) {
 			h.statsHandler(response, request, ps)
 		})
 
+	r.GET("/stats/history",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			h.statsHistoryHandler(response, request, ps)
+		})
+
+	r.POST("/stats/reset",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			h.statsResetHandler(response, request, ps)
+		})
+
 	r.PUT("/update",
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			h.updateHandler(response, request, ps)
@@ -345,6 +487,10 @@ func (h *Hammer) startApiServer() {
 }
 
 func (h *Hammer) stopApiServer() error {
+	if h.apiServer == nil {
+		return nil
+	}
+
 	if err := h.apiServer.Stop(); err != nil {
 		return err
 	}
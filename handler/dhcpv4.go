@@ -1,14 +1,20 @@
 package handler
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/ipchama/dhammer/config"
 	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/namespace"
+	"github.com/ipchama/dhammer/packet"
 	"github.com/ipchama/dhammer/socketeer"
 	"github.com/ipchama/dhammer/stats"
+	"github.com/ipchama/dhammer/vlan"
 	"github.com/vishvananda/netlink"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -19,18 +25,43 @@ type LeaseDhcpV4 struct {
 	HwAddr   net.HardwareAddr
 }
 
+/*
+	Replies are sharded across workers by client MAC, so all of a client's replies are handled in order by the same worker.
+	State that spans clients (acquired/offered IPs and the lease tracker) is shared and guarded by stateMux.
+*/
+
 type HandlerDhcpV4 struct {
-	options      *config.DhcpV4Options
-	socketeer    *socketeer.RawSocketeer
-	iface        *net.Interface
-	link         netlink.Link
-	acquiredIPs  map[string]*LeaseDhcpV4
-	addLog       func(string) bool
-	addError     func(error) bool
-	sendPayload  func([]byte) bool
-	addStat      func(stats.StatValue) bool
-	inputChannel chan message.Message
-	doneChannel  chan struct{}
+	options       *config.DhcpV4Options
+	socketeer     socketeer.Transport
+	iface         *net.Interface
+	link          netlink.Link
+	netlink       *netlink.Handle // In the socketeer's namespace.
+	acquiredIPs   map[string]*LeaseDhcpV4
+	offeredIPs    map[string]struct{}
+	leases        *leaseTracker
+	stateMux      sync.Mutex
+	addLog        func(string) bool
+	addError      func(error) bool
+	sendPayload   func([]byte) bool
+	registry      *stats.Registry
+	inputChannels []chan message.Message
+	doneChannel   chan struct{}
+
+	infoSent           *stats.Counter
+	requestSent        *stats.Counter
+	declineSent        *stats.Counter
+	releaseSent        *stats.Counter
+	offerReceived      *stats.Counter
+	ackReceived        *stats.Counter
+	nakReceived        *stats.Counter
+	arpReplySent       *stats.Counter
+	arpRequestReceived *stats.Counter
+	addressesOffered   *stats.Gauge
+
+	addressesBound       *stats.Gauge
+	clientsBound         *stats.Gauge
+	duplicateAssignments *stats.Counter
+	vlanMismatch         *stats.Counter
 }
 
 func init() {
@@ -42,38 +73,107 @@ func init() {
 func NewDhcpV4(hip HandlerInitParams) Handler {
 
 	h := HandlerDhcpV4{
-		options:      hip.options.(*config.DhcpV4Options),
-		socketeer:    hip.socketeer,
-		iface:        hip.socketeer.IfInfo,
-		acquiredIPs:  make(map[string]*LeaseDhcpV4),
-		addLog:       hip.logFunc,
-		addError:     hip.errFunc,
-		sendPayload:  hip.socketeer.AddPayload,
-		addStat:      hip.statFunc,
-		inputChannel: make(chan message.Message, 10000),
-		doneChannel:  make(chan struct{}),
+		options:     hip.options.(*config.DhcpV4Options),
+		socketeer:   hip.socketeer,
+		iface:       hip.socketeer.InterfaceInfo(),
+		acquiredIPs: make(map[string]*LeaseDhcpV4),
+		offeredIPs:  make(map[string]struct{}),
+		leases:      newLeaseTracker(),
+		addLog:      hip.logFunc,
+		addError:    hip.errFunc,
+		sendPayload: hip.socketeer.AddPayload,
+		registry:    hip.registry,
+		doneChannel: make(chan struct{}),
+	}
+
+	workers := hip.socketeer.Options().RxWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	h.inputChannels = make([]chan message.Message, workers)
+	for i := range h.inputChannels {
+		h.inputChannels[i] = make(chan message.Message, 10000)
 	}
 
 	return &h
 }
 
-func (h *HandlerDhcpV4) ReceiveMessage(msg message.Message) bool {
+func (h *HandlerDhcpV4) ReceiveMessages(msgs []message.Message) bool {
+
+	received := true
 
-	select {
-	case h.inputChannel <- msg:
-		return true
-	default:
+	for _, msg := range msgs {
+		select {
+		case h.inputChannels[h.shard(msg)] <- msg:
+		default:
+			received = false
+		}
 	}
 
-	return false
+	return received
+}
 
+// shard picks the worker for a message.  DHCP replies go by client MAC and ARP requests by the IP being asked about.
+func (h *HandlerDhcpV4) shard(msg message.Message) int {
+
+	if len(h.inputChannels) == 1 {
+		return 0
+	}
+
+	var key []byte
+
+	if dhcpLayer := msg.Packet.Layer(layers.LayerTypeDHCPv4); dhcpLayer != nil {
+		key = dhcpLayer.(*layers.DHCPv4).ClientHWAddr
+	} else if arpLayer := msg.Packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+		key = arpLayer.(*layers.ARP).DstProtAddress
+	}
+
+	// FNV-1a
+	hash := uint32(2166136261)
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+
+	return int(hash % uint32(len(h.inputChannels)))
 }
 
 func (h *HandlerDhcpV4) Init() error {
 
 	var err error = nil
 
-	h.link, err = netlink.LinkByName("lo")
+	h.infoSent = h.registry.Counter("InfoSent")
+	h.requestSent = h.registry.Counter("RequestSent")
+	h.declineSent = h.registry.Counter("DeclineSent")
+	h.releaseSent = h.registry.Counter("ReleaseSent")
+	h.offerReceived = h.registry.Counter("OfferReceived")
+	h.ackReceived = h.registry.Counter("AckReceived")
+	h.nakReceived = h.registry.Counter("NakReceived")
+	h.arpReplySent = h.registry.Counter("ArpReplySent")
+	h.arpRequestReceived = h.registry.Counter("ArpRequestReceived")
+	h.addressesOffered = h.registry.Gauge("AddressesOffered")
+	h.addressesBound = h.registry.Gauge("AddressesBound")
+	h.clientsBound = h.registry.Gauge("ClientsBound")
+	h.duplicateAssignments = h.registry.Counter("DuplicateAssignments")
+
+	// A new test phase starts counting unique offers from scratch, same as OfferReceived.
+	h.registry.OnReset(func() {
+		h.stateMux.Lock()
+		h.offeredIPs = make(map[string]struct{})
+		h.addressesOffered.Set(0)
+		h.stateMux.Unlock()
+	})
+
+	if h.options.Vlans != nil {
+		h.vlanMismatch = h.registry.Counter("VlanMismatch")
+	}
+
+	if h.netlink, err = namespace.Netlink(h.socketeer.Options().Netns); err != nil {
+		return err
+	}
+
+	h.link, err = h.netlink.LinkByName("lo")
 
 	return err
 }
@@ -82,81 +182,62 @@ func (h *HandlerDhcpV4) DeInit() error {
 
 	if h.options.Bind {
 		for _, lease := range h.acquiredIPs {
-			if err := netlink.AddrDel(h.link, lease.LinkAddr); err != nil {
+			if err := h.netlink.AddrDel(h.link, lease.LinkAddr); err != nil {
 				h.addError(err)
 			}
 		}
 	}
 
+	if h.netlink != nil {
+		h.netlink.Delete()
+	}
+
 	return nil
 }
 
 func (h *HandlerDhcpV4) Stop() error {
-	close(h.inputChannel)
+	for _, c := range h.inputChannels {
+		close(c)
+	}
 	<-h.doneChannel
 	return nil
 }
 
 func (h *HandlerDhcpV4) Run() {
 
-	var msg message.Message
-	var dhcpReply *layers.DHCPv4
-
-	socketeerOptions := h.socketeer.Options()
+	var wg sync.WaitGroup
 
-	ethernetLayer := &layers.Ethernet{
-		DstMAC:       layers.EthernetBroadcast,
-		SrcMAC:       h.iface.HardwareAddr,
-		EthernetType: layers.EthernetTypeIPv4,
-		Length:       0,
+	for _, c := range h.inputChannels {
+		wg.Add(1)
+		go func(inputChannel chan message.Message) {
+			h.runWorker(inputChannel)
+			wg.Done()
+		}(c)
 	}
 
-	if !h.options.EthernetBroadcast {
-		ethernetLayer.DstMAC = socketeerOptions.GatewayMAC
-	}
-
-	ipLayer := &layers.IPv4{
-		Version:  4, // IPv4
-		TTL:      64,
-		Protocol: 17, // UDP
-		SrcIP:    net.IPv4(0, 0, 0, 0),
-		DstIP:    net.IPv4(255, 255, 255, 255),
-	}
+	wg.Wait()
 
-	udpLayer := &layers.UDP{
-		SrcPort: layers.UDPPort(68),
-		DstPort: layers.UDPPort(h.options.TargetPort),
-	}
-
-	outDhcpLayer := &layers.DHCPv4{
-		Operation:    layers.DHCPOpRequest,
-		HardwareType: layers.LinkTypeEthernet,
-		HardwareLen:  6,
-		Flags:        0x8000, // Broadcast
-	}
-
-	if !h.options.DhcpBroadcast {
-		outDhcpLayer.Flags = 0x0
-	}
+	h.doneChannel <- struct{}{}
+}
 
-	if h.options.DhcpRelay {
-		ipLayer.SrcIP = h.options.RelaySourceIP
-		ipLayer.DstIP = h.options.RelayTargetServerIP
+func (h *HandlerDhcpV4) runWorker(inputChannel chan message.Message) {
 
-		ethernetLayer.SrcMAC = h.iface.HardwareAddr
-		ethernetLayer.DstMAC = socketeerOptions.GatewayMAC
+	var msg message.Message
+	var dhcpReply *layers.DHCPv4
 
-		outDhcpLayer.RelayAgentIP = h.options.RelayGatewayIP
-		udpLayer.SrcPort = 67
+	templates, err := h.newTemplates()
+	if err != nil {
+		h.addError(err)
+		for range inputChannel { // Nothing can be sent, but keep up with the socketeer until we're stopped.
+		}
+		return
 	}
 
-	goPacketSerializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-
-	for msg = range h.inputChannel {
+	for msg = range inputChannel {
 
 		if h.options.Arp && msg.Packet.Layer(layers.LayerTypeARP) != nil {
-			h.addStat(stats.ArpRequestReceivedStat)
-			h.handleARP(msg)
+			h.arpRequestReceived.Inc()
+			h.handleARP(msg, templates)
 			continue
 		} else if msg.Packet.Layer(layers.LayerTypeDHCPv4) == nil {
 			continue
@@ -164,6 +245,25 @@ func (h *HandlerDhcpV4) Run() {
 
 		dhcpReply = msg.Packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
 
+		// Replies have to come back on the client's own VLANs, and anything we send for the client goes out on them too.
+		var stack vlan.Stack
+		vlanName := ""
+
+		if h.options.Vlans != nil {
+			stack = vlan.FromPacket(msg.Packet)
+			vlanName = stack.String()
+
+			if expected, found := h.options.Vlans.Lookup(dhcpReply.ClientHWAddr); !found || !stack.Equal(expected) {
+				if vlanName == "" {
+					vlanName = "untagged"
+				}
+
+				h.vlanMismatch.Inc()
+				h.vlanMismatch.IncBy("vlan", vlanName)
+				continue
+			}
+		}
+
 		var replyOptions [256]layers.DHCPOption
 
 		for _, option := range dhcpReply.Options { // Assuming that we'll expand on usage of options in the reply later and just doing this now.
@@ -172,86 +272,110 @@ func (h *HandlerDhcpV4) Run() {
 
 		replyMsgType := replyOptions[layers.DHCPOptMessageType].Data[0]
 
-		//h.addLog(fmt.Sprintf("[REPLY] %v %v %v %v %v", dhcpReply.Options[0].String(), dhcpReply.YourClientIP.String(), string(dhcpReply.ServerName), dhcpReply.ClientIP.String(), dhcpReply.ClientHWAddr))
+		var serverID, sourceIP net.IP
 
-		if replyMsgType == (byte)(layers.DHCPMsgTypeOffer) {
+		if len(replyOptions[layers.DHCPOptServerID].Data) == net.IPv4len {
+			serverID = net.IP(replyOptions[layers.DHCPOptServerID].Data)
+		}
 
-			h.addStat(stats.OfferReceivedStat)
+		if ipLayer := msg.Packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+			sourceIP = ipLayer.(*layers.IPv4).SrcIP
+		}
 
-			if h.options.Handshake {
+		//h.addLog(fmt.Sprintf("[REPLY] %v %v %v %v %v", dhcpReply.Options[0].String(), dhcpReply.YourClientIP.String(), string(dhcpReply.ServerName), dhcpReply.ClientIP.String(), dhcpReply.ClientHWAddr))
 
-				buf := gopacket.NewSerializeBuffer()
+		if replyMsgType == (byte)(layers.DHCPMsgTypeOffer) {
 
-				outDhcpLayer.Xid = dhcpReply.Xid
+			countReply(h.offerReceived, serverID, sourceIP, vlanName)
 
-				outDhcpLayer.Options = make(layers.DHCPOptions, 4)
+			h.stateMux.Lock()
+			if _, found := h.offeredIPs[dhcpReply.YourClientIP.String()]; !found {
+				h.offeredIPs[dhcpReply.YourClientIP.String()] = struct{}{}
+				h.addressesOffered.Set(float64(len(h.offeredIPs)))
+			}
+			h.stateMux.Unlock()
 
-				if h.options.DhcpDecline {
-					outDhcpLayer.Options[0] = layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeDecline)})
-				} else {
-					outDhcpLayer.Options[0] = layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)})
-				}
+			if !h.options.Handshake {
+				h.options.Transactions.Finish(dhcpReply.Xid, "offer", time.Now())
+			} else {
 
-				outDhcpLayer.Options[1] = layers.NewDHCPOption(layers.DHCPOptRequestIP, dhcpReply.YourClientIP)
-				outDhcpLayer.Options[2] = layers.NewDHCPOption(layers.DHCPOptServerID, replyOptions[layers.DHCPOptServerID].Data)
-				outDhcpLayer.Options[3] = layers.NewDHCPOption(layers.DHCPOptEnd, []byte{})
+				frame := templates.request.Frame()
 
-				outDhcpLayer.ClientHWAddr = dhcpReply.ClientHWAddr
+				if h.options.ClientSourceMAC {
+					templates.request.SetSrcMAC(frame, dhcpReply.ClientHWAddr)
+				}
 
-				udpLayer.SetNetworkLayerForChecksum(ipLayer)
+				templates.request.SetVlans(frame, stack)
+				templates.request.SetXid(frame, dhcpReply.Xid)
+				templates.request.SetChaddr(frame, dhcpReply.ClientHWAddr)
 
-				gopacket.SerializeLayers(buf, goPacketSerializeOpts,
-					ethernetLayer,
-					ipLayer,
-					udpLayer,
-					outDhcpLayer,
-				)
+				if !templates.request.SetOption(frame, layers.DHCPOptRequestIP, dhcpReply.YourClientIP.To4()) ||
+					!templates.request.SetOption(frame, layers.DHCPOptServerID, replyOptions[layers.DHCPOptServerID].Data) {
+					packet.Release(frame)
+					h.addError(fmt.Errorf("Offer to %s has no usable address or server identifier", dhcpReply.ClientHWAddr))
+					continue
+				}
 
-				if h.sendPayload(buf.Bytes()) {
+				if h.sendPayload(frame) {
 					if h.options.DhcpDecline {
-						h.addStat(stats.DeclineSentStat)
+						countSent(h.declineSent, vlanName)
+
+						// Nothing comes back for a DECLINE.
+						h.options.Transactions.Finish(dhcpReply.Xid, "decline", time.Now())
 					} else {
-						h.addStat(stats.RequestSentStat)
+						countSent(h.requestSent, vlanName)
 					}
 				}
 			}
 		} else if replyMsgType == (byte)(layers.DHCPMsgTypeAck) {
 
-			h.addStat(stats.AckReceivedStat)
+			countReply(h.ackReceived, serverID, sourceIP, vlanName)
+
+			// ACKs to a DHCPINFORM don't hand out an address.
+			if !dhcpReply.YourClientIP.IsUnspecified() {
+				h.bindLease(dhcpReply, replyOptions[layers.DHCPOptLeaseTime].Data)
+			}
 
 			if h.options.Arp || h.options.Bind {
 
 				ipStr := dhcpReply.YourClientIP.String()
 
-				if _, found := h.acquiredIPs[ipStr]; !found {
+				h.stateMux.Lock()
+
+				lease, found := h.acquiredIPs[ipStr]
 
-					h.acquiredIPs[ipStr] = &LeaseDhcpV4{
+				if !found {
+					lease = &LeaseDhcpV4{
 						Packet:   msg.Packet,
 						Acquired: time.Now(),
 						HwAddr:   dhcpReply.ClientHWAddr,
 					}
 
-					if h.options.Bind {
+					h.acquiredIPs[ipStr] = lease
+				}
+
+				h.stateMux.Unlock()
 
-						// Need to fix the CIDR here...
-						if addr, err := netlink.ParseAddr(ipStr + "/32"); err != nil {
-							h.addError(err)
-						} else if err = netlink.AddrAdd(h.link, addr); err != nil {
-							h.addError(err)
-						} else {
-							h.acquiredIPs[ipStr].LinkAddr = addr
-						}
+				if !found && h.options.Arp {
+					if err := h.socketeer.ClaimAddress(dhcpReply.YourClientIP); err != nil {
+						h.addError(err)
 					}
 				}
-			}
 
-			if h.options.DhcpRelease || h.options.DhcpInfo {
+				if !found && h.options.Bind {
 
-				buf := gopacket.NewSerializeBuffer()
-
-				outDhcpLayer.Xid = dhcpReply.Xid
+					// Need to fix the CIDR here...
+					if addr, err := netlink.ParseAddr(ipStr + "/32"); err != nil {
+						h.addError(err)
+					} else if err = h.netlink.AddrAdd(h.link, addr); err != nil {
+						h.addError(err)
+					} else {
+						lease.LinkAddr = addr
+					}
+				}
+			}
 
-				/* We have to unicast DHCPRELEASE - https://tools.ietf.org/html/rfc2131#section-4.4.4 */
+			if h.options.DhcpRelease || h.options.DhcpInfo {
 
 				dhcpReplyEtherFrame := msg.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
 
@@ -262,110 +386,137 @@ func (h *HandlerDhcpV4) Run() {
 
 				dhcpReplyIpHeader := msg.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 
-				releaseEthernetLayer := &layers.Ethernet{
-					DstMAC:       dhcpReplyEtherFrame.SrcMAC,
-					SrcMAC:       h.iface.HardwareAddr,
-					EthernetType: layers.EthernetTypeIPv4,
-					Length:       0,
+				srcMAC := h.iface.HardwareAddr
+				if h.options.ClientSourceMAC {
+					srcMAC = dhcpReply.ClientHWAddr
 				}
 
-				releaseIpLayer := &layers.IPv4{
-					Version:  4, // IPv4
-					TTL:      64,
-					Protocol: 17, // UDP
-					SrcIP:    dhcpReply.YourClientIP,
-					DstIP:    dhcpReplyIpHeader.SrcIP,
-				}
+				frame := templates.release.Frame()
 
-				previousClientIP := outDhcpLayer.ClientIP
-				outDhcpLayer.ClientIP = dhcpReply.YourClientIP
+				templates.release.SetVlans(frame, stack)
+				templates.release.SetEthernet(frame, dhcpReplyEtherFrame.SrcMAC, srcMAC)
+				templates.release.SetIPs(frame, dhcpReply.YourClientIP, dhcpReplyIpHeader.SrcIP)
+				templates.release.SetXid(frame, dhcpReply.Xid)
+				templates.release.SetCiaddr(frame, dhcpReply.YourClientIP)
+				templates.release.SetChaddr(frame, dhcpReply.ClientHWAddr)
 
-				outDhcpLayer.Options = make(layers.DHCPOptions, 2)
-
-				previousFlags := outDhcpLayer.Flags
-				outDhcpLayer.Flags = 0x0
+				if h.sendPayload(frame) {
+					if h.options.DhcpInfo {
+						countSent(h.infoSent, vlanName)
+					} else {
+						countSent(h.releaseSent, vlanName)
 
-				if h.options.DhcpInfo {
-					outDhcpLayer.Options[0] = layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeInform)})
-				} else {
-					outDhcpLayer.Options[0] = layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRelease)})
+						h.stateMux.Lock()
+						h.leases.release(dhcpReply.YourClientIP)
+						h.stateMux.Unlock()
+					}
 				}
-				outDhcpLayer.Options[1] = layers.NewDHCPOption(layers.DHCPOptEnd, []byte{})
-
-				outDhcpLayer.ClientHWAddr = dhcpReply.ClientHWAddr
-
-				udpLayer.SetNetworkLayerForChecksum(ipLayer)
+			}
 
-				gopacket.SerializeLayers(buf, goPacketSerializeOpts,
-					releaseEthernetLayer,
-					releaseIpLayer,
-					udpLayer,
-					outDhcpLayer,
-				)
+			// With --info, the transaction goes on until the INFORM is ACKed, which has no address in it.
+			if !h.options.DhcpInfo || dhcpReply.YourClientIP.IsUnspecified() {
+				h.options.Transactions.Finish(dhcpReply.Xid, "ack", time.Now())
+			}
 
-				// Reset ClientIP to what it was.  It might have been an IP or it might have been 0.0.0.0, depending what options were used.
-				outDhcpLayer.ClientIP = previousClientIP
-				// Similarly for flags.
-				outDhcpLayer.Flags = previousFlags
+		} else if replyMsgType == (byte)(layers.DHCPMsgTypeNak) {
+			countReply(h.nakReceived, serverID, sourceIP, vlanName)
 
-				if h.sendPayload(buf.Bytes()) {
-					if h.options.DhcpInfo {
-						h.addStat(stats.InfoSentStat)
-					} else {
-						h.addStat(stats.ReleaseSentStat)
-					}
-				}
+			reason := string(replyOptions[layers.DHCPOptMessage].Data)
+			if reason == "" {
+				reason = "unspecified"
 			}
+			h.nakReceived.IncBy("reason", reason)
 
-		} else if dhcpReply.Options[0].Data[0] == (byte)(layers.DHCPMsgTypeNak) {
-			h.addStat(stats.NakReceivedStat)
+			h.options.Transactions.Finish(dhcpReply.Xid, "nak", time.Now())
 		}
 	}
+}
 
-	h.doneChannel <- struct{}{}
+func (h *HandlerDhcpV4) bindLease(dhcpReply *layers.DHCPv4, leaseTimeData []byte) {
+
+	var leaseTime time.Duration
+
+	// 0xffffffff is an infinite lease, which the tracker treats the same as no lease time at all.
+	if len(leaseTimeData) == 4 && binary.BigEndian.Uint32(leaseTimeData) != 0xffffffff {
+		leaseTime = time.Duration(binary.BigEndian.Uint32(leaseTimeData)) * time.Second
+	}
+
+	h.stateMux.Lock()
+	previous := h.leases.bind(dhcpReply.YourClientIP, dhcpReply.ClientHWAddr, leaseTime, time.Now())
+	h.addressesBound.Set(float64(h.leases.uniqueIPs()))
+	h.clientsBound.Set(float64(h.leases.uniqueClients()))
+	h.stateMux.Unlock()
+
+	if previous != nil {
+		h.duplicateAssignments.Inc()
+		h.addLog(fmt.Sprintf("Duplicate assignment: %s ACKed to %s while still leased to %s.", dhcpReply.YourClientIP, dhcpReply.ClientHWAddr, previous))
+	}
 }
 
-func (h *HandlerDhcpV4) handleARP(msg message.Message) {
+func (h *HandlerDhcpV4) handleARP(msg message.Message, templates *dhcpV4Templates) {
 	arpRequest := msg.Packet.Layer(layers.LayerTypeARP).(*layers.ARP)
 
-	if arpRequest.Operation == layers.ARPRequest {
-		if lease, found := h.acquiredIPs[net.IP(arpRequest.DstProtAddress).String()]; found {
+	if arpRequest.Operation != layers.ARPRequest || arpRequest.HwAddressSize != 6 || arpRequest.ProtAddressSize != net.IPv4len {
+		return
+	}
+
+	h.stateMux.Lock()
+	lease, found := h.acquiredIPs[net.IP(arpRequest.DstProtAddress).String()]
+	h.stateMux.Unlock()
 
-			goPacketSerializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if !found {
+		return
+	}
 
-			ethernetLayer := &layers.Ethernet{
-				DstMAC:       net.HardwareAddr(arpRequest.SourceHwAddress),
-				SrcMAC:       h.iface.HardwareAddr,
-				EthernetType: layers.EthernetTypeARP,
-				Length:       0,
-			}
+	// Answer on whatever VLANs the request came in on.
+	stack := vlan.FromPacket(msg.Packet)
 
-			arpLayer := &layers.ARP{
-				Operation:         layers.ARPReply,
-				DstHwAddress:      arpRequest.SourceHwAddress,
-				DstProtAddress:    arpRequest.SourceProtAddress,
-				HwAddressSize:     arpRequest.HwAddressSize,
-				AddrType:          arpRequest.AddrType,
-				ProtAddressSize:   arpRequest.ProtAddressSize,
-				Protocol:          arpRequest.Protocol,
-				SourceHwAddress:   h.iface.HardwareAddr,
-				SourceProtAddress: arpRequest.DstProtAddress,
-			}
+	template, err := h.arpTemplate(templates, len(stack))
+	if err != nil {
+		h.addError(err)
+		return
+	}
 
-			if h.options.ArpFakeMAC {
-				arpLayer.SourceHwAddress = lease.HwAddr
-			}
+	senderHwAddr := h.iface.HardwareAddr
+	if h.options.ArpFakeMAC || h.options.ClientSourceMAC {
+		senderHwAddr = lease.HwAddr
+	}
 
-			buf := gopacket.NewSerializeBuffer()
+	// The client answers for itself when it has a MAC of its own on the wire.
+	srcMAC := h.iface.HardwareAddr
+	if h.options.ClientSourceMAC {
+		srcMAC = lease.HwAddr
+	}
 
-			gopacket.SerializeLayers(buf, goPacketSerializeOpts,
-				ethernetLayer,
-				arpLayer,
-			)
+	frame := template.Frame()
 
-			if h.sendPayload(buf.Bytes()) {
-				h.addStat(stats.ArpReplySentStat)
-			}
-		}
+	template.SetVlans(frame, stack)
+	template.SetEthernet(frame, arpRequest.SourceHwAddress, srcMAC)
+	template.SetARP(frame, senderHwAddr, arpRequest.DstProtAddress, arpRequest.SourceHwAddress, arpRequest.SourceProtAddress)
+
+	if h.sendPayload(frame) {
+		h.arpReplySent.Inc()
+	}
+}
+
+// countReply counts a reply along with the server identifier (option 54), source IP and VLANs it came from.
+func countReply(c *stats.Counter, serverID net.IP, sourceIP net.IP, vlanName string) {
+	countSent(c, vlanName)
+
+	if serverID != nil {
+		c.IncBy("server_id", serverID.String())
+	}
+
+	if sourceIP != nil {
+		c.IncBy("source_ip", sourceIP.String())
+	}
+}
+
+// countSent counts a message along with the client's VLANs, if clients are tagged.
+func countSent(c *stats.Counter, vlanName string) {
+	c.Inc()
+
+	if vlanName != "" {
+		c.IncBy("vlan", vlanName)
 	}
 }
@@ -9,7 +9,7 @@ import (
 )
 
 type Handler interface {
-	ReceiveMessage(m message.Message) bool
+	ReceiveMessages(m []message.Message) bool
 	Init() error
 	Run()
 	Stop() error
@@ -18,10 +18,10 @@ type Handler interface {
 
 type HandlerInitParams struct {
 	options   config.HammerConfig
-	socketeer *socketeer.RawSocketeer
+	socketeer socketeer.Transport
 	logFunc   func(string) bool
 	errFunc   func(error) bool
-	statFunc  func(stats.StatValue) bool
+	registry  *stats.Registry
 }
 
 var handlers map[string]func(HandlerInitParams) Handler = make(map[string]func(HandlerInitParams) Handler)
@@ -36,13 +36,13 @@ func AddHandler(s string, f func(HandlerInitParams) Handler) error {
 	return nil
 }
 
-func New(s *socketeer.RawSocketeer, o config.HammerConfig, logFunc func(string) bool, errFunc func(error) bool, statFunc func(stats.StatValue) bool) (Handler, error) {
+func New(s socketeer.Transport, o config.HammerConfig, logFunc func(string) bool, errFunc func(error) bool, r *stats.Registry) (Handler, error) {
 	hip := HandlerInitParams{
 		options:   o,
 		socketeer: s,
 		logFunc:   logFunc,
 		errFunc:   errFunc,
-		statFunc:  statFunc,
+		registry:  r,
 	}
 
 	hf, ok := handlers[o.HammerType()]
@@ -22,7 +22,7 @@ func (t *TestHandler) Init() error {
 	return nil
 }
 
-func (t *TestHandler) ReceiveMessage(m message.Message) bool {
+func (t *TestHandler) ReceiveMessages(m []message.Message) bool {
 	return true
 }
 
@@ -43,7 +43,7 @@ func TestNew(t *testing.T) {
 		hType: "__TEST__",
 	}
 
-	if _, err := handler.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, func(stats.StatValue) bool { return true }); err == nil {
+	if _, err := handler.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err == nil {
 		t.Errorf("Handler factory did not return error for unknown type.")
 	}
 
@@ -55,7 +55,7 @@ func TestNew(t *testing.T) {
 		t.Errorf("Handler factory allowed duplicate type.")
 	}
 
-	if _, err := handler.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, func(stats.StatValue) bool { return true }); err != nil {
+	if _, err := handler.New(nil, o, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err != nil {
 		t.Errorf("Handler factory failed to return known type.")
 	}
 
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+/*
+	The lease tracker counts leases rather than ACKs.  Retransmits and renewals of the same IP to the same client
+	don't add anything, but the same IP being ACKed to a different client while the first lease is still live
+	is a duplicate assignment.
+*/
+
+type trackedLease struct {
+	hwAddr  net.HardwareAddr
+	expires time.Time // Zero for leases without a lease time (option 51), which never expire.
+}
+
+type leaseTracker struct {
+	leases  map[string]*trackedLease
+	clients map[string]struct{}
+}
+
+func newLeaseTracker() *leaseTracker {
+	return &leaseTracker{
+		leases:  make(map[string]*trackedLease),
+		clients: make(map[string]struct{}),
+	}
+}
+
+// bind records ip as leased to hwAddr.  If a different client still holds a live lease on ip, that client's MAC is returned.
+func (t *leaseTracker) bind(ip net.IP, hwAddr net.HardwareAddr, leaseTime time.Duration, now time.Time) net.HardwareAddr {
+
+	var duplicateOf net.HardwareAddr
+
+	ipStr := ip.String()
+
+	lease, found := t.leases[ipStr]
+
+	if found && !bytes.Equal(lease.hwAddr, hwAddr) && (lease.expires.IsZero() || lease.expires.After(now)) {
+		duplicateOf = lease.hwAddr
+	}
+
+	if !found {
+		lease = &trackedLease{}
+		t.leases[ipStr] = lease
+	}
+
+	lease.hwAddr = append(net.HardwareAddr{}, hwAddr...)
+	lease.expires = time.Time{}
+
+	if leaseTime > 0 {
+		lease.expires = now.Add(leaseTime)
+	}
+
+	t.clients[hwAddr.String()] = struct{}{}
+
+	return duplicateOf
+}
+
+// release ends the lease on ip early, e.g. after a DHCPRELEASE, so the server handing it out again isn't a duplicate.
+func (t *leaseTracker) release(ip net.IP) {
+	if lease, found := t.leases[ip.String()]; found {
+		lease.expires = time.Unix(0, 0)
+	}
+}
+
+func (t *leaseTracker) uniqueIPs() int {
+	return len(t.leases)
+}
+
+func (t *leaseTracker) uniqueClients() int {
+	return len(t.clients)
+}
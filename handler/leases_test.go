@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLeaseTracker(t *testing.T) {
+
+	tracker := newLeaseTracker()
+	now := time.Now()
+
+	ip := net.IPv4(10, 0, 0, 5)
+	macA := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	macB := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+
+	if dup := tracker.bind(ip, macA, time.Hour, now); dup != nil {
+		t.Errorf("First lease reported as a duplicate of %s.", dup)
+	}
+
+	if dup := tracker.bind(ip, macA, time.Hour, now.Add(time.Minute)); dup != nil {
+		t.Errorf("Renewal reported as a duplicate of %s.", dup)
+	}
+
+	if dup := tracker.bind(ip, macB, time.Hour, now.Add(2*time.Minute)); dup.String() != macA.String() {
+		t.Errorf("Duplicate assignment not detected.")
+	}
+
+	if dup := tracker.bind(ip, macA, time.Hour, now.Add(3*time.Hour)); dup != nil {
+		t.Errorf("Reassignment after expiry reported as a duplicate of %s.", dup)
+	}
+
+	tracker.release(ip)
+
+	if dup := tracker.bind(ip, macB, time.Hour, now.Add(3*time.Hour)); dup != nil {
+		t.Errorf("Reassignment after release reported as a duplicate of %s.", dup)
+	}
+
+	if tracker.uniqueIPs() != 1 || tracker.uniqueClients() != 2 {
+		t.Errorf("Expected 1 unique IP and 2 unique clients, got %d and %d.", tracker.uniqueIPs(), tracker.uniqueClients())
+	}
+}
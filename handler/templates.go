@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/packet"
+	"github.com/ipchama/dhammer/vlan"
+	"net"
+)
+
+// dhcpV4Templates are a worker's frame templates.  Everything that differs between clients is patched in per frame.
+type dhcpV4Templates struct {
+	request *packet.Template         // REQUEST, or DECLINE with --decline
+	release *packet.Template         // RELEASE, or INFORM with --info
+	arp     map[int]*packet.Template // ARP replies, by number of VLAN tags
+}
+
+func (h *HandlerDhcpV4) newTemplates() (*dhcpV4Templates, error) {
+
+	var err error
+
+	t := &dhcpV4Templates{
+		arp: make(map[int]*packet.Template),
+	}
+
+	socketeerOptions := h.socketeer.Options()
+
+	depth := 0
+	if h.options.Vlans != nil {
+		depth = h.options.Vlans.Depth()
+	}
+
+	ethernetLayer := &layers.Ethernet{
+		DstMAC:       layers.EthernetBroadcast,
+		SrcMAC:       h.iface.HardwareAddr,
+		EthernetType: layers.EthernetTypeIPv4,
+		Length:       0,
+	}
+
+	if !h.options.EthernetBroadcast {
+		ethernetLayer.DstMAC = socketeerOptions.GatewayMAC
+	}
+
+	ipLayer := &layers.IPv4{
+		Version:  4, // IPv4
+		TTL:      64,
+		Protocol: 17, // UDP
+		SrcIP:    net.IPv4(0, 0, 0, 0),
+		DstIP:    net.IPv4(255, 255, 255, 255),
+	}
+
+	udpLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(68),
+		DstPort: layers.UDPPort(h.options.TargetPort),
+	}
+
+	outDhcpLayer := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Flags:        0x8000,                    // Broadcast
+		ClientHWAddr: make(net.HardwareAddr, 6), // Patched per client, but FixLengths takes HardwareLen from it.
+	}
+
+	if !h.options.DhcpBroadcast {
+		outDhcpLayer.Flags = 0x0
+	}
+
+	if h.options.DhcpRelay {
+		ipLayer.SrcIP = h.options.RelaySourceIP
+		ipLayer.DstIP = h.options.RelayTargetServerIP
+
+		ethernetLayer.SrcMAC = h.iface.HardwareAddr
+		ethernetLayer.DstMAC = socketeerOptions.GatewayMAC
+
+		outDhcpLayer.RelayAgentIP = h.options.RelayGatewayIP
+		udpLayer.SrcPort = 67
+	}
+
+	msgType := layers.DHCPMsgTypeRequest
+	if h.options.DhcpDecline {
+		msgType = layers.DHCPMsgTypeDecline
+	}
+
+	outDhcpLayer.Options = layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, make([]byte, net.IPv4len)),
+		layers.NewDHCPOption(layers.DHCPOptServerID, make([]byte, net.IPv4len)),
+		layers.NewDHCPOption(layers.DHCPOptEnd, []byte{}),
+	}
+
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	if t.request, err = packet.NewTemplate(vlan.Placeholder(depth).Wrap(ethernetLayer, layers.EthernetTypeIPv4,
+		ipLayer,
+		udpLayer,
+		outDhcpLayer,
+	)...); err != nil {
+		return nil, err
+	}
+
+	/*
+		We have to unicast DHCPRELEASE - https://tools.ietf.org/html/rfc2131#section-4.4.4
+		The server's MAC and IP, and the client's IP, are patched in per frame.
+	*/
+
+	releaseEthernetLayer := &layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		DstMAC:       make(net.HardwareAddr, 6),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	releaseIpLayer := &layers.IPv4{
+		Version:  4, // IPv4
+		TTL:      64,
+		Protocol: 17, // UDP
+		SrcIP:    net.IPv4(0, 0, 0, 0),
+		DstIP:    net.IPv4(0, 0, 0, 0),
+	}
+
+	releaseUdpLayer := *udpLayer
+	releaseUdpLayer.SetNetworkLayerForChecksum(releaseIpLayer)
+
+	releaseDhcpLayer := *outDhcpLayer
+	releaseDhcpLayer.Flags = 0x0
+
+	msgType = layers.DHCPMsgTypeRelease
+	if h.options.DhcpInfo {
+		msgType = layers.DHCPMsgTypeInform
+	}
+
+	releaseDhcpLayer.Options = layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		layers.NewDHCPOption(layers.DHCPOptEnd, []byte{}),
+	}
+
+	if t.release, err = packet.NewTemplate(vlan.Placeholder(depth).Wrap(releaseEthernetLayer, layers.EthernetTypeIPv4,
+		releaseIpLayer,
+		&releaseUdpLayer,
+		&releaseDhcpLayer,
+	)...); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// arpTemplate gives the ARP reply template for requests with depth VLAN tags, making it the first time it's needed.
+func (h *HandlerDhcpV4) arpTemplate(t *dhcpV4Templates, depth int) (*packet.Template, error) {
+
+	if template, found := t.arp[depth]; found {
+		return template, nil
+	}
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		DstMAC:       make(net.HardwareAddr, 6),
+		EthernetType: layers.EthernetTypeARP,
+	}
+
+	arpLayer := &layers.ARP{
+		Operation:         layers.ARPReply,
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   net.IPv4len,
+		SourceHwAddress:   make([]byte, 6),
+		SourceProtAddress: make([]byte, net.IPv4len),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    make([]byte, net.IPv4len),
+	}
+
+	template, err := packet.NewTemplate(vlan.Placeholder(depth).Wrap(ethernetLayer, layers.EthernetTypeARP, arpLayer)...)
+	if err != nil {
+		return nil, err
+	}
+
+	t.arp[depth] = template
+
+	return template, nil
+}
@@ -0,0 +1,80 @@
+package namespace
+
+import (
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"runtime"
+	"strings"
+)
+
+/*
+	Network namespaces are per thread, not per process.  Anything that opens a socket (AF_PACKET, UDP, the netlink
+	sockets behind net.InterfaceByName and the netlink package's default handle) does it in the namespace of whatever
+	thread it happens to run on.  Sockets stay in the namespace they were opened in, though, so it's enough to open them
+	on a thread that's been switched over and switch it back afterwards.
+
+	A namespace is either a name, as in "ip netns", or a path to one, e.g. /proc/<pid>/ns/net.  "" is the one we started in.
+*/
+
+func open(ns string) (netns.NsHandle, error) {
+	if strings.Contains(ns, "/") {
+		return netns.GetFromPath(ns)
+	}
+
+	return netns.GetFromName(ns)
+}
+
+// Do runs f inside the namespace.
+func Do(ns string, f func() error) error {
+
+	if ns == "" {
+		return f()
+	}
+
+	target, err := open(ns)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	if err = netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+
+	fErr := f()
+
+	// If we can't switch back, the thread stays locked and goes away with this goroutine instead of being reused.
+	if err = netns.Set(origin); err != nil {
+		return err
+	}
+
+	runtime.UnlockOSThread()
+
+	return fErr
+}
+
+// Netlink gives a netlink handle that works inside the namespace from any thread.
+func Netlink(ns string) (*netlink.Handle, error) {
+
+	if ns == "" {
+		return netlink.NewHandle()
+	}
+
+	target, err := open(ns)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	return netlink.NewHandleAt(target)
+}
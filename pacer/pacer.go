@@ -0,0 +1,161 @@
+package pacer
+
+import (
+	"github.com/ipchama/dhammer/stats"
+	"math"
+	"math/rand"
+	"time"
+)
+
+/*
+	A token bucket:  Tokens trickle in at the target rate, up to the burst size, and every frame takes one.
+	When the bucket's empty, Take says how long until the next token so the caller can sleep instead of spinning.
+	Timers oversleep, so the burst is what lets a sender catch up afterwards without losing rate.  By default it's
+	one token more than can trickle in while oversleeping, which keeps the spacing smooth and the average right.
+
+	Changing the rate keeps the tokens already earned, so nothing is reset.
+
+	With Poisson arrivals the gaps between frames are drawn from an exponential distribution instead, averaging out to
+	the same rate, to look more like lots of independent clients.  Late frames still go out to keep the average, but
+	never more than a burst of them.
+*/
+
+const (
+	measureInterval = time.Second
+	timerSlack      = 2 * time.Millisecond // Roughly how late timers fire on a busy box.
+)
+
+type Pacer struct {
+	rate      float64 // Tokens per second.  0 == unlimited.
+	burst     float64
+	autoBurst bool
+	tokens    float64
+	last      time.Time
+
+	random *rand.Rand // Only set for Poisson arrivals.
+	next   time.Time
+
+	windowStart time.Time
+	windowSent  int
+
+	targetRate   *stats.Gauge
+	achievedRate *stats.Gauge
+	pacingError  *stats.Gauge
+}
+
+// New makes a pacer for rate frames per second.  A burst of 0 or less picks one from the rate.
+func New(rate int, burst int, registry *stats.Registry, now time.Time) *Pacer {
+
+	p := &Pacer{
+		autoBurst:    burst <= 0,
+		burst:        float64(burst),
+		last:         now,
+		windowStart:  now,
+		targetRate:   registry.Gauge("PacingTargetRate"),
+		achievedRate: registry.Gauge("PacingAchievedRate"),
+		pacingError:  registry.MeanGauge("PacingError"),
+	}
+
+	p.SetRate(rate, now)
+	p.tokens = p.burst
+
+	return p
+}
+
+// SetRate changes the target rate from now on.
+func (p *Pacer) SetRate(rate int, now time.Time) {
+
+	p.refill(now)
+
+	if rate < 0 {
+		rate = 0
+	}
+
+	p.rate = float64(rate)
+
+	if p.autoBurst {
+		p.burst = math.Ceil(1 + p.rate*timerSlack.Seconds())
+	}
+
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+
+	p.targetRate.Set(p.rate)
+}
+
+// Poisson switches to exponentially distributed gaps between frames.
+func (p *Pacer) Poisson(random *rand.Rand, now time.Time) {
+	p.random = random
+	p.next = now
+}
+
+func (p *Pacer) Rate() int {
+	return int(p.rate)
+}
+
+func (p *Pacer) Burst() int {
+	return int(p.burst)
+}
+
+// Take takes a token and returns 0 if there is one, otherwise it takes nothing and returns how long until there is.
+func (p *Pacer) Take(now time.Time) time.Duration {
+
+	if p.rate > 0 && p.random != nil {
+		if now.Before(p.next) {
+			return p.next.Sub(now)
+		}
+
+		if now.Sub(p.next).Seconds()*p.rate > p.burst {
+			p.next = now
+		}
+
+		p.next = p.next.Add(time.Duration(p.random.ExpFloat64() / p.rate * float64(time.Second)))
+	} else if p.rate > 0 {
+		p.refill(now)
+
+		if p.tokens < 1 {
+			return time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+		}
+
+		p.tokens--
+	}
+
+	p.windowSent++
+
+	if elapsed := now.Sub(p.windowStart); elapsed >= measureInterval {
+		p.measure(elapsed)
+		p.windowStart = now
+		p.windowSent = 0
+	}
+
+	return 0
+}
+
+func (p *Pacer) refill(now time.Time) {
+
+	if elapsed := now.Sub(p.last).Seconds(); elapsed > 0 {
+		p.tokens += elapsed * p.rate
+
+		if p.tokens > p.burst {
+			p.tokens = p.burst
+		}
+	}
+
+	p.last = now
+}
+
+// measure updates the achieved rate, and the pacing error as a percentage of the target.  It's measured on Take
+// rather than on stats ticks, so time spent blocked on a full transport queue counts against it.
+func (p *Pacer) measure(elapsed time.Duration) {
+
+	achieved := float64(p.windowSent) / elapsed.Seconds()
+
+	p.achievedRate.Set(achieved)
+
+	if p.rate > 0 {
+		p.pacingError.Set((achieved - p.rate) / p.rate * 100)
+	} else {
+		p.pacingError.Set(0)
+	}
+}
@@ -0,0 +1,132 @@
+package pacer
+
+import (
+	"github.com/ipchama/dhammer/stats"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// run sends as fast as the pacer allows for d, oversleeping every wait by oversleep, and returns how many were sent.
+func run(p *Pacer, now time.Time, d time.Duration, oversleep time.Duration) (int, time.Time) {
+	sent := 0
+
+	for end := now.Add(d); now.Before(end); {
+		if wait := p.Take(now); wait > 0 {
+			now = now.Add(wait + oversleep)
+			continue
+		}
+		sent++
+	}
+
+	return sent, now
+}
+
+func TestPacer(t *testing.T) {
+
+	now := time.Unix(0, 0)
+	registry := stats.NewRegistry()
+
+	p := New(1000, 0, registry, now)
+
+	if p.Burst() != 3 {
+		t.Errorf("Unexpected automatic burst %d", p.Burst())
+	}
+
+	// A millisecond of oversleeping on every wait would halve the rate without the burst to catch up with.
+	p = New(1000, 10, registry, now)
+
+	sent, now := run(p, now, 10*time.Second, time.Millisecond)
+	if math.Abs(float64(sent)-10000) > 20 {
+		t.Errorf("Sent %d in 10s at 1000/s", sent)
+	}
+
+	if achieved := registry.Gauge("PacingAchievedRate").Value(); math.Abs(achieved-1000) > 20 {
+		t.Errorf("Achieved rate is %f", achieved)
+	}
+
+	if e := registry.Gauge("PacingError").Value(); math.Abs(e) > 2 {
+		t.Errorf("Pacing error is %f%%", e)
+	}
+
+	// Changing the rate doesn't reset anything.
+	p.SetRate(100, now)
+
+	if registry.Gauge("PacingTargetRate").Value() != 100 {
+		t.Errorf("Target rate is %f", registry.Gauge("PacingTargetRate").Value())
+	}
+
+	if sent, now = run(p, now, 10*time.Second, 0); math.Abs(float64(sent)-1000) > 10 {
+		t.Errorf("Sent %d in 10s at 100/s", sent)
+	}
+
+	p.SetRate(0, now)
+
+	for i := 0; i < 1000000; i++ {
+		if p.Take(now) != 0 {
+			t.Fatal("Unlimited pacer made us wait")
+		}
+	}
+}
+
+func TestPacerSpacing(t *testing.T) {
+
+	now := time.Unix(0, 0)
+	p := New(10, 1, stats.NewRegistry(), now)
+
+	p.Take(now) // The initial burst.
+
+	for i := 0; i < 10; i++ {
+		wait := p.Take(now)
+		if wait != 100*time.Millisecond {
+			t.Fatalf("Waiting %v between frames at 10/s", wait)
+		}
+
+		now = now.Add(wait)
+
+		if p.Take(now) != 0 {
+			t.Fatal("No token after waiting")
+		}
+	}
+}
+
+func TestPacerPoisson(t *testing.T) {
+
+	now := time.Unix(0, 0)
+	p := New(1000, 0, stats.NewRegistry(), now)
+	p.Poisson(rand.New(rand.NewSource(1)), now)
+
+	var gaps []float64
+	last := now
+
+	for end := now.Add(10 * time.Second); now.Before(end); {
+		if wait := p.Take(now); wait > 0 {
+			now = now.Add(wait)
+			continue
+		}
+
+		gaps = append(gaps, now.Sub(last).Seconds())
+		last = now
+	}
+
+	if math.Abs(float64(len(gaps))-10000) > 400 {
+		t.Errorf("Sent %d in 10s at 1000/s", len(gaps))
+	}
+
+	// Exponential gaps have a standard deviation as big as their mean, where even spacing has none.
+	mean, variance := 0.0, 0.0
+	for _, g := range gaps {
+		mean += g
+	}
+	mean /= float64(len(gaps))
+
+	for _, g := range gaps {
+		variance += (g - mean) * (g - mean)
+	}
+	variance /= float64(len(gaps))
+
+	if cv := math.Sqrt(variance) / mean; cv < 0.9 || cv > 1.1 {
+		t.Errorf("Gaps don't look exponential, coefficient of variation is %f", cv)
+	}
+}
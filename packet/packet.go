@@ -0,0 +1,293 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/vlan"
+	"net"
+)
+
+/*
+	Frames are built from templates:  everything is serialized once with gopacket, and each frame after that is a copy of
+	the template into a pooled buffer with only the fields that change patched in.  Checksums are patched incrementally
+	(RFC 1624) rather than recomputed.
+
+	Buffers handed to a transport belong to the transport, which gives them back with Release once they're on the wire.
+*/
+
+const (
+	BufferSize = 2048
+	poolSize   = 8192
+
+	ipChecksumOffset  = 10
+	ipSrcOffset       = 12
+	udpChecksumOffset = 6
+
+	dhcpXidOffset     = 4
+	dhcpCiaddrOffset  = 12
+	dhcpChaddrOffset  = 28
+	dhcpOptionsOffset = 240 // After the magic cookie.
+
+	arpSenderHwOffset = 8
+)
+
+var free = make(chan []byte, poolSize)
+
+// Get returns a buffer of length n, from the pool if there's one there.
+func Get(n int) []byte {
+	if n <= BufferSize {
+		select {
+		case b := <-free:
+			return b[:n]
+		default:
+			return make([]byte, n, BufferSize)
+		}
+	}
+
+	return make([]byte, n)
+}
+
+// Release gives a buffer back to the pool.  Nothing may touch it afterwards.
+func Release(b []byte) {
+	if cap(b) < BufferSize {
+		return
+	}
+
+	select {
+	case free <- b[:0]:
+	default:
+	}
+}
+
+// Serialize is for one-off frames that aren't worth a template.  The frame is in a pooled buffer.
+func Serialize(l ...gopacket.SerializableLayer) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+		return nil, err
+	}
+
+	b := Get(len(buf.Bytes()))
+	copy(b, buf.Bytes())
+
+	return b, nil
+}
+
+type Template struct {
+	data []byte
+
+	depth   int // VLAN tags
+	ipOff   int // -1 when there's no such layer.
+	udpOff  int
+	dhcpOff int
+	arpOff  int
+
+	options map[layers.DHCPOpt]int // Offsets of the option data.
+}
+
+// NewTemplate serializes the layers, which should look like Stack.Wrap output, and finds where everything ended up.
+// Set the UDP layer's network layer for checksums first.
+func NewTemplate(l ...gopacket.SerializableLayer) (*Template, error) {
+
+	buf := gopacket.NewSerializeBuffer()
+
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+		return nil, err
+	}
+
+	t := &Template{
+		data:    append([]byte(nil), buf.Bytes()...),
+		ipOff:   -1,
+		udpOff:  -1,
+		dhcpOff: -1,
+		arpOff:  -1,
+		options: make(map[layers.DHCPOpt]int),
+	}
+
+	if len(t.data) > BufferSize {
+		return nil, errors.New("Template is too large for a packet buffer")
+	}
+
+	offset := 0
+
+	for _, layer := range gopacket.NewPacket(t.data, layers.LayerTypeEthernet, gopacket.Default).Layers() {
+		switch layer.LayerType() {
+		case layers.LayerTypeDot1Q:
+			t.depth++
+		case layers.LayerTypeIPv4:
+			t.ipOff = offset
+		case layers.LayerTypeUDP:
+			t.udpOff = offset
+		case layers.LayerTypeDHCPv4:
+			t.dhcpOff = offset
+
+			// FixLengths takes the hardware length from chaddr, so an empty one can't be patched later.
+			if layer.(*layers.DHCPv4).HardwareLen == 0 {
+				return nil, errors.New("DHCP template needs a placeholder chaddr")
+			}
+		case layers.LayerTypeARP:
+			t.arpOff = offset
+		}
+
+		offset += len(layer.LayerContents())
+	}
+
+	if t.dhcpOff >= 0 {
+		for i := t.dhcpOff + dhcpOptionsOffset; i < len(t.data) && t.data[i] != byte(layers.DHCPOptEnd); {
+			if t.data[i] == byte(layers.DHCPOptPad) {
+				i++
+				continue
+			}
+
+			t.options[layers.DHCPOpt(t.data[i])] = i + 2
+			i += 2 + int(t.data[i+1])
+		}
+	}
+
+	return t, nil
+}
+
+// Frame copies the template into a pooled buffer.
+func (t *Template) Frame() []byte {
+	b := Get(len(t.data))
+	copy(b, t.data)
+	return b
+}
+
+// Depth is the number of VLAN tags the template has room for.
+func (t *Template) Depth() int {
+	return t.depth
+}
+
+func (t *Template) SetEthernet(b []byte, dst net.HardwareAddr, src net.HardwareAddr) {
+	copy(b[0:6], dst)
+	copy(b[6:12], src)
+}
+
+func (t *Template) SetSrcMAC(b []byte, src net.HardwareAddr) {
+	copy(b[6:12], src)
+}
+
+// SetVlans writes the stack's TPIDs and IDs into the tags.  The stack has to be as deep as the template.
+func (t *Template) SetVlans(b []byte, s vlan.Stack) {
+	for i, tag := range s {
+		if i == t.depth {
+			return
+		}
+
+		binary.BigEndian.PutUint16(b[12+4*i:], uint16(tag.TPID))
+		binary.BigEndian.PutUint16(b[14+4*i:], tag.ID)
+	}
+}
+
+// SetIPs patches the IPv4 source and destination, and both checksums.
+func (t *Template) SetIPs(b []byte, src net.IP, dst net.IP) {
+	off := t.ipOff + ipSrcOffset
+
+	t.patch(b, off, src.To4(), true)
+	t.patch(b, off+4, dst.To4(), true)
+}
+
+func (t *Template) SetXid(b []byte, xid uint32) {
+	var x [4]byte
+	binary.BigEndian.PutUint32(x[:], xid)
+	t.patch(b, t.dhcpOff+dhcpXidOffset, x[:], false)
+}
+
+func (t *Template) SetChaddr(b []byte, mac net.HardwareAddr) {
+	var chaddr [16]byte
+	copy(chaddr[:], mac)
+	t.patch(b, t.dhcpOff+dhcpChaddrOffset, chaddr[:], false)
+}
+
+func (t *Template) SetCiaddr(b []byte, ip net.IP) {
+	t.patch(b, t.dhcpOff+dhcpCiaddrOffset, ip.To4(), false)
+}
+
+// SetOption overwrites an option the template already has.  It returns false if there's no such option or the data is a different length.
+func (t *Template) SetOption(b []byte, code layers.DHCPOpt, data []byte) bool {
+	off, found := t.options[code]
+
+	if !found || int(t.data[off-1]) != len(data) {
+		return false
+	}
+
+	t.patch(b, off, data, false)
+
+	return true
+}
+
+// SetARP patches the sender and target addresses of an ARP template.
+func (t *Template) SetARP(b []byte, senderHw []byte, senderIP []byte, targetHw []byte, targetIP []byte) {
+	off := t.arpOff + arpSenderHwOffset
+
+	copy(b[off:off+6], senderHw)
+	copy(b[off+6:off+10], senderIP)
+	copy(b[off+10:off+16], targetHw)
+	copy(b[off+16:off+20], targetIP)
+}
+
+// patch writes data at off and fixes up the UDP checksum, and the IPv4 header checksum for header fields.
+func (t *Template) patch(b []byte, off int, data []byte, ipHeader bool) {
+
+	if len(data) == 0 {
+		return
+	}
+
+	old := b[off : off+len(data)]
+
+	if ipHeader {
+		updateChecksum(b[t.ipOff+ipChecksumOffset:], old, data, off-t.ipOff, false)
+	}
+
+	// The addresses are in the UDP pseudo-header, which is word aligned just like the IP header.
+	if t.udpOff >= 0 && (ipHeader || off >= t.udpOff) {
+		updateChecksum(b[t.udpOff+udpChecksumOffset:], old, data, off-t.ipOff, true)
+	}
+
+	copy(old, data)
+}
+
+// updateChecksum adjusts the checksum at sum for old being replaced by new, position bytes from a word boundary.
+// A zero UDP checksum means none was computed, so it's left alone, and a result of zero is sent as 0xffff.
+func updateChecksum(sum []byte, old []byte, new []byte, position int, udp bool) {
+
+	hc := binary.BigEndian.Uint16(sum)
+
+	if udp && hc == 0 {
+		return
+	}
+
+	// HC' = ~(~HC + ~m + m')
+	total := uint32(^hc) + uint32(^fold(wordSum(old, position))) + uint32(fold(wordSum(new, position)))
+	result := ^fold(total)
+
+	if udp && result == 0 {
+		result = 0xffff
+	}
+
+	binary.BigEndian.PutUint16(sum, result)
+}
+
+func wordSum(data []byte, position int) uint32 {
+	var sum uint32
+
+	for i, v := range data {
+		if (position+i)%2 == 0 {
+			sum += uint32(v) << 8
+		} else {
+			sum += uint32(v)
+		}
+	}
+
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,134 @@
+package packet
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/vlan"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+type dhcpFields struct {
+	stack     vlan.Stack
+	src, dst  net.IP
+	xid       uint32
+	chaddr    net.HardwareAddr
+	ciaddr    net.IP
+	requestIP net.IP
+}
+
+func layersFor(f dhcpFields) []gopacket.SerializableLayer {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: layers.EthernetBroadcast}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: f.src, DstIP: f.dst}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          f.xid,
+		ClientHWAddr: f.chaddr,
+		ClientIP:     f.ciaddr,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)}),
+			layers.NewDHCPOption(layers.DHCPOptRequestIP, f.requestIP.To4()),
+			layers.NewDHCPOption(layers.DHCPOptEnd, nil),
+		},
+	}
+
+	return f.stack.Wrap(eth, layers.EthernetTypeIPv4, ip, udp, dhcp)
+}
+
+// build serializes the whole frame the slow way.
+func build(t *testing.T, f dhcpFields) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, layersFor(f)...); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func randomIP(r *rand.Rand) net.IP {
+	return net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
+}
+
+func TestTemplate(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+
+	base := dhcpFields{
+		stack:     vlan.Stack{{TPID: layers.EthernetTypeQinQ, ID: 1}, {TPID: layers.EthernetTypeDot1Q, ID: 1}},
+		src:       net.IPv4(0, 0, 0, 0),
+		dst:       net.IPv4(255, 255, 255, 255),
+		chaddr:    make(net.HardwareAddr, 6),
+		ciaddr:    net.IPv4(0, 0, 0, 0),
+		requestIP: net.IPv4(0, 0, 0, 0),
+	}
+
+	tmpl, err := NewTemplate(layersFor(base)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tmpl.Depth() != 2 {
+		t.Fatalf("Template has %d tags, expected 2", tmpl.Depth())
+	}
+
+	for i := 0; i < 1000; i++ {
+		f := dhcpFields{
+			stack:     vlan.Stack{{TPID: layers.EthernetTypeQinQ, ID: uint16(r.Intn(4094) + 1)}, {TPID: layers.EthernetTypeDot1Q, ID: uint16(r.Intn(4094) + 1)}},
+			src:       randomIP(r),
+			dst:       randomIP(r),
+			xid:       r.Uint32(),
+			chaddr:    net.HardwareAddr{byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))},
+			ciaddr:    randomIP(r),
+			requestIP: randomIP(r),
+		}
+
+		b := tmpl.Frame()
+		tmpl.SetVlans(b, f.stack)
+		tmpl.SetIPs(b, f.src, f.dst)
+		tmpl.SetXid(b, f.xid)
+		tmpl.SetChaddr(b, f.chaddr)
+		tmpl.SetCiaddr(b, f.ciaddr)
+
+		if !tmpl.SetOption(b, layers.DHCPOptRequestIP, f.requestIP.To4()) {
+			t.Fatal("Request IP option not found in the template")
+		}
+
+		if expected := build(t, f); !bytes.Equal(b, expected) {
+			t.Fatalf("Patched frame differs from a serialized one:\n%x\n%x", b, expected)
+		}
+
+		Release(b)
+	}
+
+	if tmpl.SetOption(tmpl.Frame(), layers.DHCPOptServerID, []byte{1, 2, 3, 4}) {
+		t.Error("Set an option the template doesn't have")
+	}
+
+	base.chaddr = nil
+	if _, err := NewTemplate(layersFor(base)...); err == nil {
+		t.Error("Expected an error for a template without a chaddr")
+	}
+}
+
+func TestPool(t *testing.T) {
+	b := Get(100)
+	if len(b) != 100 || cap(b) < BufferSize {
+		t.Errorf("Unexpected buffer: len %d cap %d", len(b), cap(b))
+	}
+
+	Release(b)
+
+	// Small buffers that didn't come from the pool are just dropped.
+	Release(make([]byte, 10))
+
+	if b := Get(BufferSize + 1); len(b) != BufferSize+1 {
+		t.Errorf("Unexpected buffer length %d", len(b))
+	}
+}
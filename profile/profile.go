@@ -0,0 +1,290 @@
+package profile
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	A load profile is a list of phases, each with a shape that gives the target rate at any point in it.  The generator
+	asks for the rate every so often and hands it to its pacer, so a profile only ever sets a target.
+
+	Phases are written the same way on the command line and in a profile file, one per flag or line:
+
+		ramp,duration=5m,from=0,to=1000
+		steps,duration=10m,from=100,to=1000,steps=10
+		sine,duration=1h,rate=500,amplitude=300,period=10m
+		diurnal,duration=24h,min=50,max=2000,period=24h
+		burst,duration=30m,rate=100,peak=5000,every=1m,length=5s
+		constant,rate=200,name=cooldown
+
+	A phase without a duration lasts forever, so only the last one can leave it out.  In a file, "loop" on a line
+	of its own starts over after the last phase, and anything after a # is a comment.
+*/
+
+type Shape string
+
+const (
+	Constant Shape = "constant"
+	Ramp     Shape = "ramp"    // Linear from From to To.
+	Steps    Shape = "steps"   // From to To in equal stairs.
+	Sine     Shape = "sine"    // Rate +- Amplitude, starting at Rate and going up.
+	Diurnal  Shape = "diurnal" // Min at the start of the period, Max halfway through.
+	Burst    Shape = "burst"   // Peak for Length at the start of every Every, Rate the rest of the time.
+)
+
+type Phase struct {
+	Name     string
+	Shape    Shape
+	Duration time.Duration // 0 == forever.
+
+	Rate      int
+	From      int
+	To        int
+	Steps     int
+	Amplitude int
+	Min       int
+	Max       int
+	Peak      int
+
+	Period time.Duration
+	Every  time.Duration
+	Length time.Duration
+}
+
+type Profile struct {
+	Phases []Phase
+	Loop   bool
+}
+
+// At gives the target rate and phase name at elapsed time into the profile, or done once the profile is over.
+func (p *Profile) At(elapsed time.Duration) (rate int, phase string, done bool) {
+
+	var total time.Duration
+
+	for _, ph := range p.Phases {
+		if ph.Duration == 0 {
+			total = 0
+			break
+		}
+		total += ph.Duration
+	}
+
+	if p.Loop && total > 0 {
+		elapsed %= total
+	}
+
+	for _, ph := range p.Phases {
+		if ph.Duration == 0 || elapsed < ph.Duration {
+			return ph.rate(elapsed), ph.Name, false
+		}
+		elapsed -= ph.Duration
+	}
+
+	return 0, "", true
+}
+
+func (ph *Phase) rate(t time.Duration) int {
+
+	var r float64
+
+	switch ph.Shape {
+	case Constant:
+		r = float64(ph.Rate)
+	case Ramp:
+		r = float64(ph.From) + float64(ph.To-ph.From)*fraction(t, ph.Duration)
+	case Steps:
+		stair := math.Floor(fraction(t, ph.Duration) * float64(ph.Steps))
+		if ph.Steps > 1 {
+			r = float64(ph.From) + float64(ph.To-ph.From)*stair/float64(ph.Steps-1)
+		} else {
+			r = float64(ph.From)
+		}
+	case Sine:
+		r = float64(ph.Rate) + float64(ph.Amplitude)*math.Sin(2*math.Pi*fraction(t%ph.Period, ph.Period))
+	case Diurnal:
+		r = float64(ph.Min) + float64(ph.Max-ph.Min)*(1-math.Cos(2*math.Pi*fraction(t%ph.Period, ph.Period)))/2
+	case Burst:
+		r = float64(ph.Rate)
+		if t%ph.Every < ph.Length {
+			r = float64(ph.Peak)
+		}
+	}
+
+	if r < 0 {
+		return 0
+	}
+
+	return int(math.Round(r))
+}
+
+func fraction(t time.Duration, of time.Duration) float64 {
+	if of <= 0 {
+		return 0
+	}
+
+	return float64(t) / float64(of)
+}
+
+// ParsePhase reads a phase from <shape>[,key=value...].
+func ParsePhase(spec string) (Phase, error) {
+
+	parts := strings.Split(spec, ",")
+
+	ph := Phase{
+		Name:  strings.TrimSpace(parts[0]),
+		Shape: Shape(strings.TrimSpace(parts[0])),
+		Steps: 5,
+	}
+
+	for _, part := range parts[1:] {
+		keyValCombo := strings.SplitN(part, "=", 2)
+		if len(keyValCombo) != 2 {
+			return ph, errors.New("Profile phase settings must be in the format <name>=<value>: " + spec)
+		}
+
+		key, value := strings.TrimSpace(keyValCombo[0]), strings.TrimSpace(keyValCombo[1])
+
+		var err error
+
+		switch key {
+		case "name":
+			ph.Name = value
+		case "duration":
+			ph.Duration, err = time.ParseDuration(value)
+		case "period":
+			ph.Period, err = time.ParseDuration(value)
+		case "every":
+			ph.Every, err = time.ParseDuration(value)
+		case "length":
+			ph.Length, err = time.ParseDuration(value)
+		case "rate":
+			ph.Rate, err = strconv.Atoi(value)
+		case "from":
+			ph.From, err = strconv.Atoi(value)
+		case "to":
+			ph.To, err = strconv.Atoi(value)
+		case "steps":
+			ph.Steps, err = strconv.Atoi(value)
+		case "amplitude":
+			ph.Amplitude, err = strconv.Atoi(value)
+		case "min":
+			ph.Min, err = strconv.Atoi(value)
+		case "max":
+			ph.Max, err = strconv.Atoi(value)
+		case "peak":
+			ph.Peak, err = strconv.Atoi(value)
+		default:
+			return ph, errors.New("Unknown profile phase setting " + key + " in " + spec)
+		}
+
+		if err != nil {
+			return ph, errors.New("Bad value for " + key + " in " + spec + ": " + err.Error())
+		}
+	}
+
+	return ph, ph.validate()
+}
+
+func (ph *Phase) validate() error {
+
+	if ph.Duration < 0 || ph.Period < 0 || ph.Every < 0 || ph.Length < 0 {
+		return errors.New("Profile phase " + ph.Name + " can't have a negative duration, period, every or length")
+	}
+
+	switch ph.Shape {
+	case Constant, Ramp:
+	case Steps:
+		if ph.Steps < 1 {
+			return errors.New("Profile phase " + ph.Name + " needs at least one step")
+		}
+	case Sine, Diurnal:
+		if ph.Period <= 0 {
+			if ph.Shape == Sine {
+				return errors.New("Profile phase " + ph.Name + " needs a period")
+			}
+			ph.Period = 24 * time.Hour
+		}
+	case Burst:
+		if ph.Every <= 0 || ph.Length <= 0 {
+			return errors.New("Profile phase " + ph.Name + " needs every and length")
+		}
+	default:
+		return errors.New("Unknown profile phase shape: " + string(ph.Shape))
+	}
+
+	if ph.Duration == 0 && (ph.Shape == Ramp || ph.Shape == Steps) {
+		return errors.New("Profile phase " + ph.Name + " needs a duration")
+	}
+
+	return nil
+}
+
+// New makes a profile from phase specs, checking that only the last one goes on forever.
+func New(specs []string, loop bool) (*Profile, error) {
+
+	p := &Profile{Loop: loop}
+
+	for i, spec := range specs {
+		ph, err := ParsePhase(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if ph.Duration == 0 && i != len(specs)-1 {
+			return nil, errors.New("Only the last profile phase can go without a duration: " + spec)
+		}
+
+		p.Phases = append(p.Phases, ph)
+	}
+
+	if len(p.Phases) == 0 {
+		return nil, errors.New("A profile needs at least one phase")
+	}
+
+	return p, nil
+}
+
+// Load reads a profile file.
+func Load(path string) (*Profile, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var specs []string
+	loop := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		} else if line == "loop" {
+			loop = true
+			continue
+		}
+
+		specs = append(specs, line)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return New(specs, loop)
+}
@@ -0,0 +1,70 @@
+package profile
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+
+	p, err := New([]string{
+		"ramp,name=warmup,duration=10s,from=0,to=1000",
+		"steps,duration=40s,from=100,to=400,steps=4",
+		"burst,duration=1m,rate=100,peak=5000,every=10s,length=1s",
+		"sine,duration=1m,rate=500,amplitude=100,period=20s",
+	}, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		at    time.Duration
+		rate  int
+		phase string
+	}{
+		{0, 0, "warmup"},
+		{5 * time.Second, 500, "warmup"},
+		{10 * time.Second, 100, "steps"},
+		{25 * time.Second, 200, "steps"},
+		{49 * time.Second, 400, "steps"},
+		{50 * time.Second, 5000, "burst"},
+		{52 * time.Second, 100, "burst"},
+		{60500 * time.Millisecond, 5000, "burst"},
+		{115 * time.Second, 600, "sine"},
+		{125 * time.Second, 400, "sine"},
+	} {
+		rate, phase, done := p.At(c.at)
+		if rate != c.rate || phase != c.phase || done {
+			t.Errorf("At %v: %d in %q (done %v), expected %d in %q", c.at, rate, phase, done, c.rate, c.phase)
+		}
+	}
+
+	if _, _, done := p.At(170 * time.Second); !done {
+		t.Error("Profile isn't done after its last phase")
+	}
+
+	p.Loop = true
+
+	if rate, phase, done := p.At(175 * time.Second); rate != 500 || phase != "warmup" || done {
+		t.Errorf("Looped profile gave %d in %q (done %v)", rate, phase, done)
+	}
+
+	for _, bad := range [][]string{
+		{"constant,rate=10", "ramp,duration=1m,from=0,to=10"}, // Only the last phase can go on forever.
+		{"zigzag,duration=1m"},
+		{"sine,duration=1m,rate=10"},
+		{"ramp,from=0,to=10"},
+		{"constant,rate=ten"},
+		{"constant,speed=10"},
+		{"constant,duration=-5m,rate=10"},
+		{"sine,duration=1m,rate=10,amplitude=5,period=-1m"},
+		{"diurnal,duration=1m,min=1,max=10,period=-1h"},
+		{"burst,duration=1m,rate=10,peak=100,every=-10s,length=1s"},
+		{"constant,duration=1m,rate=10,length=-1s"},
+	} {
+		if _, err := New(bad, false); err == nil {
+			t.Errorf("No error for %v", bad)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package socketeer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/packet"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Capture:  Every frame the transport sends, and every frame it hands back, is also written to a pcapng file.
+	Each frame carries its direction (epb_flags) and a comment with the client MAC, xid and DHCP message type, so a run
+	can be picked apart in Wireshark without a tcpdump running alongside.
+
+	Files rotate once they pass CaptureMaxBytes (capture.pcapng, capture-1.pcapng, ...), and capturing stops for good after
+	CaptureMaxPackets frames.  gopacket's pcapng writer can't do per-packet options, hence the little writer below.
+*/
+
+const (
+	pcapngBlockSHB = 0x0a0d0d0a
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngOptEnd       = 0
+	pcapngOptComment   = 1
+	pcapngOptIfName    = 2
+	pcapngOptEpbFlags  = 2
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+
+	captureQueueSize = 4096 // Frames waiting to be written.  Past that they're left out of the capture.
+)
+
+type captureWriter struct {
+	mux sync.Mutex
+
+	path       string
+	ifName     string
+	maxBytes   int64
+	maxPackets int
+
+	file      *os.File
+	w         *bufio.Writer
+	written   int64
+	packets   int
+	fileIndex int
+	full      bool
+
+	addLog func(string) bool
+}
+
+func newCaptureWriter(path string, ifName string, maxBytes int64, maxPackets int, logFunc func(string) bool) (*captureWriter, error) {
+
+	c := &captureWriter{
+		path:       path,
+		ifName:     ifName,
+		maxBytes:   maxBytes,
+		maxPackets: maxPackets,
+		addLog:     logFunc,
+	}
+
+	return c, c.open()
+}
+
+func (c *captureWriter) fileName() string {
+	if c.fileIndex == 0 {
+		return c.path
+	}
+
+	ext := filepath.Ext(c.path)
+	return strings.TrimSuffix(c.path, ext) + "-" + strconv.Itoa(c.fileIndex) + ext
+}
+
+func (c *captureWriter) open() error {
+	var err error
+
+	if c.file, err = os.Create(c.fileName()); err != nil {
+		return err
+	}
+
+	c.w = bufio.NewWriterSize(c.file, 1<<16)
+	c.written = 0
+
+	// Section header.
+	shb := make([]byte, 0, 28)
+	shb = appendUint32(shb, pcapngBlockSHB)
+	shb = appendUint32(shb, 28)
+	shb = appendUint32(shb, 0x1a2b3c4d)
+	shb = appendUint16(shb, 1)
+	shb = appendUint16(shb, 0)
+	shb = appendUint32(shb, 0xffffffff) // Section length unknown.
+	shb = appendUint32(shb, 0xffffffff)
+	shb = appendUint32(shb, 28)
+
+	// Interface description.
+	var opts []byte
+	opts = appendOption(opts, pcapngOptIfName, []byte(c.ifName))
+	opts = appendOption(opts, pcapngOptEnd, nil)
+
+	idbLen := uint32(20 + len(opts))
+	idb := make([]byte, 0, idbLen)
+	idb = appendUint32(idb, pcapngBlockIDB)
+	idb = appendUint32(idb, idbLen)
+	idb = appendUint16(idb, uint16(layers.LinkTypeEthernet))
+	idb = appendUint16(idb, 0)
+	idb = appendUint32(idb, 0) // No snap length limit.
+	idb = append(idb, opts...)
+	idb = appendUint32(idb, idbLen)
+
+	return c.writeBlock(append(shb, idb...))
+}
+
+func (c *captureWriter) writeBlock(b []byte) error {
+	n, err := c.w.Write(b)
+	c.written += int64(n)
+	return err
+}
+
+func (c *captureWriter) rotate() error {
+	if err := c.closeFile(); err != nil {
+		return err
+	}
+
+	c.fileIndex++
+
+	return c.open()
+}
+
+func (c *captureWriter) write(data []byte, outbound bool, comment string, ts time.Time) error {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.full {
+		return nil
+	}
+
+	if c.maxPackets > 0 && c.packets >= c.maxPackets {
+		c.full = true
+		c.addLog("Capture packet limit reached.  No more frames will be captured.")
+		return nil
+	}
+
+	if c.maxBytes > 0 && c.written >= c.maxBytes {
+		if err := c.rotate(); err != nil {
+			c.full = true
+			return err
+		}
+	}
+
+	flags := uint32(pcapngFlagInbound)
+	if outbound {
+		flags = pcapngFlagOutbound
+	}
+
+	var opts []byte
+	opts = appendOption(opts, pcapngOptEpbFlags, appendUint32(nil, flags))
+	if comment != "" {
+		opts = appendOption(opts, pcapngOptComment, []byte(comment))
+	}
+	opts = appendOption(opts, pcapngOptEnd, nil)
+
+	padded := (len(data) + 3) &^ 3
+	blockLen := uint32(32 + padded + len(opts))
+	micros := uint64(ts.UnixNano() / 1000)
+
+	epb := make([]byte, 0, blockLen)
+	epb = appendUint32(epb, pcapngBlockEPB)
+	epb = appendUint32(epb, blockLen)
+	epb = appendUint32(epb, 0) // Interface ID
+	epb = appendUint32(epb, uint32(micros>>32))
+	epb = appendUint32(epb, uint32(micros))
+	epb = appendUint32(epb, uint32(len(data)))
+	epb = appendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, padded-len(data))...)
+	epb = append(epb, opts...)
+	epb = appendUint32(epb, blockLen)
+
+	c.packets++
+
+	return c.writeBlock(epb)
+}
+
+func (c *captureWriter) closeFile() error {
+	err := c.w.Flush()
+
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (c *captureWriter) close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.full = true
+
+	return c.closeFile()
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// annotate describes a frame for the capture comment.
+func annotate(p gopacket.Packet) string {
+
+	if dhcpLayer := p.Layer(layers.LayerTypeDHCPv4); dhcpLayer != nil {
+		dhcp := dhcpLayer.(*layers.DHCPv4)
+
+		state := "Unknown"
+		for _, option := range dhcp.Options {
+			if option.Type == layers.DHCPOptMessageType && len(option.Data) == 1 {
+				state = layers.DHCPMsgType(option.Data[0]).String()
+			}
+		}
+
+		return fmt.Sprintf("client=%s xid=0x%08x state=%s", dhcp.ClientHWAddr, dhcp.Xid, state)
+	}
+
+	if arpLayer := p.Layer(layers.LayerTypeARP); arpLayer != nil {
+		arp := arpLayer.(*layers.ARP)
+
+		if arp.Operation == layers.ARPRequest {
+			return "arp who-has " + net.IP(arp.DstProtAddress).String()
+		}
+
+		return "arp reply " + net.IP(arp.SourceProtAddress).String() + " is-at " + net.HardwareAddr(arp.SourceHwAddress).String()
+	}
+
+	return ""
+}
+
+// capturedFrame is a copy of a frame waiting for the capture goroutine.
+type capturedFrame struct {
+	data     []byte
+	outbound bool
+	ts       time.Time
+}
+
+// capturingTransport tees everything going through another transport into a capture file.
+type capturingTransport struct {
+	Transport
+
+	options *config.SocketeerOptions
+	logFunc func(string) bool
+	errFunc func(error) bool
+
+	capture *captureWriter
+
+	queueMux sync.RWMutex
+	queue    chan capturedFrame
+	closed   bool
+	done     chan struct{}
+	dropped  int64
+}
+
+func (t *capturingTransport) Init() error {
+	var err error
+
+	if err = t.Transport.Init(); err != nil {
+		return err
+	}
+
+	ifName := t.options.InterfaceName
+	if iface := t.Transport.InterfaceInfo(); iface != nil {
+		ifName = iface.Name
+	}
+
+	if t.capture, err = newCaptureWriter(t.options.CaptureFile, ifName, t.options.CaptureMaxBytes, t.options.CaptureMaxPackets, t.logFunc); err != nil {
+		return err
+	}
+
+	t.queue = make(chan capturedFrame, captureQueueSize)
+	t.done = make(chan struct{})
+
+	go t.run()
+
+	return nil
+}
+
+func (t *capturingTransport) DeInit() error {
+	err := t.Transport.DeInit()
+
+	if t.capture == nil {
+		return err
+	}
+
+	// The writer can still be draining its queue, so anything it sends from here on is dropped rather than captured.
+	t.queueMux.Lock()
+	t.closed = true
+	close(t.queue)
+	t.queueMux.Unlock()
+
+	<-t.done
+
+	if dropped := atomic.LoadInt64(&t.dropped); dropped > 0 {
+		t.logFunc("Capture fell behind and left out " + strconv.FormatInt(dropped, 10) + " frames.")
+	}
+
+	if captureErr := t.capture.close(); err == nil {
+		err = captureErr
+	}
+
+	return err
+}
+
+// run decodes, annotates and writes captured frames, so neither the listener nor the writer waits on it.
+func (t *capturingTransport) run() {
+
+	for f := range t.queue {
+		p := gopacket.NewPacket(f.data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+		if err := t.capture.write(f.data, f.outbound, annotate(p), f.ts); err != nil {
+			t.errFunc(err)
+		}
+
+		packet.Release(f.data)
+	}
+
+	close(t.done)
+}
+
+// enqueue copies a frame for the capture goroutine, since the caller can reuse it as soon as this returns.
+func (t *capturingTransport) enqueue(data []byte, outbound bool, ts time.Time) {
+
+	t.queueMux.RLock()
+	defer t.queueMux.RUnlock()
+
+	if t.closed {
+		return
+	}
+
+	dup := packet.Get(len(data))
+	copy(dup, data)
+
+	select {
+	case t.queue <- capturedFrame{data: dup, outbound: outbound, ts: ts}:
+	default:
+		packet.Release(dup)
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *capturingTransport) SetReceiver(receiverFunc func(msgs []message.Message) bool) {
+	t.Transport.SetReceiver(func(msgs []message.Message) bool {
+		now := time.Now()
+
+		for _, msg := range msgs {
+			t.enqueue(msg.Packet.Data(), false, now)
+		}
+
+		return receiverFunc(msgs)
+	})
+}
+
+// sent is the wrapped transport's sentFunc, so only frames that actually went out are captured as outbound.
+func (t *capturingTransport) sent(payload []byte) {
+	t.enqueue(payload, true, time.Now())
+}
@@ -0,0 +1,198 @@
+package socketeer
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/packet"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func discoverFrame(t *testing.T, xid uint32) []byte {
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	ipLayer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(0, 0, 0, 0),
+		DstIP:    net.IPv4(255, 255, 255, 255),
+	}
+
+	udpLayer := &layers.UDP{SrcPort: 68, DstPort: 67}
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	dhcpLayer := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          xid,
+		ClientHWAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeDiscover)}),
+			layers.NewDHCPOption(layers.DHCPOptEnd, nil),
+		},
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ethernetLayer, ipLayer, udpLayer, dhcpLayer); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCaptureWriter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dhammer-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "capture.pcapng")
+
+	// Small enough to rotate after a couple of frames, and capped at 5 frames.
+	c, err := newCaptureWriter(path, "eth0", 700, 5, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := discoverFrame(t, 0x1234)
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+
+	if comment := annotate(p); comment != "client=00:01:02:03:04:05 xid=0x00001234 state=Discover" {
+		t.Errorf("Unexpected annotation: %s", comment)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := c.write(frame, i%2 == 0, annotate(p), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(files) < 2 {
+		t.Fatalf("Capture did not rotate: %v", files)
+	}
+
+	total := 0
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for {
+			data, _, err := r.ReadPacketData()
+			if err != nil {
+				break
+			}
+
+			if len(data) != len(frame) {
+				t.Errorf("%s: captured %d bytes, expected %d", name, len(data), len(frame))
+			}
+
+			total++
+		}
+
+		f.Close()
+	}
+
+	if total != 5 {
+		t.Errorf("Captured %d frames, expected the cap of 5", total)
+	}
+}
+
+func TestCapturingTransportCapturesSentFrames(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dhammer-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &config.SocketeerOptions{
+		Transport:     "pcap",
+		InterfaceName: "dhammer-test0",
+		PcapFile:      filepath.Join(dir, "sent.pcap"),
+		CaptureFile:   filepath.Join(dir, "capture.pcapng"),
+	}
+
+	tr, err := New(o, func(string) bool { return true }, func(error) bool { return true }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tr.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	go tr.RunWriter()
+
+	for xid := uint32(1); xid <= 2; xid++ {
+		frame := discoverFrame(t, xid)
+		payload := packet.Get(len(frame))
+		copy(payload, frame)
+		tr.AddPayload(payload)
+	}
+
+	if err = tr.StopWriter(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tr.DeInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(o.CaptureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+
+		if comment := annotate(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)); comment != fmt.Sprintf("client=00:01:02:03:04:05 xid=0x%08x state=Discover", total+1) {
+			t.Errorf("Unexpected frame in the capture: %s", comment)
+		}
+
+		total++
+	}
+
+	if total != 2 {
+		t.Errorf("Captured %d sent frames, expected 2", total)
+	}
+}
@@ -0,0 +1,95 @@
+package socketeer
+
+import (
+	"errors"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/stats"
+	"net"
+)
+
+// Transport is anything that can put frames from the generator and handler on a wire and hand received frames to a receiver.
+// Receivers are given frames in batches, though a batch can be a single frame.
+// A payload belongs to the transport once it's added, even if AddPayload returns false, and goes back to the packet pool when the transport is done with it.
+type Transport interface {
+	Init() error
+	DeInit() error
+	SetReceiver(receiverFunc func(msgs []message.Message) bool)
+	AddPayload(payload []byte) bool
+	RunListener()
+	RunWriter()
+	StopListener() error
+	StopWriter() error
+	Options() config.SocketeerOptions
+	InterfaceInfo() *net.Interface
+	ClaimAddress(ip net.IP) error // The handler answers ARP for ip from now on.  Only matters to transports that filter ARP.
+}
+
+type TransportInitParams struct {
+	options  *config.SocketeerOptions
+	logFunc  func(string) bool
+	errFunc  func(error) bool
+	registry *stats.Registry
+	sentFunc sentFunc
+}
+
+// sentFunc is handed every frame a transport actually got out, before the payload goes back to the pool.  A nil sentFunc does nothing.
+type sentFunc func(payload []byte)
+
+func (f sentFunc) sent(payload []byte) {
+	if f != nil {
+		f(payload)
+	}
+}
+
+var transports map[string]func(TransportInitParams) Transport = make(map[string]func(TransportInitParams) Transport)
+
+func AddTransport(s string, f func(TransportInitParams) Transport) error {
+	if _, found := transports[s]; found {
+		return errors.New("Transport type already exists: " + s)
+	}
+
+	transports[s] = f
+
+	return nil
+}
+
+func New(o *config.SocketeerOptions, logFunc func(string) bool, errFunc func(error) bool, r *stats.Registry) (Transport, error) {
+	tip := TransportInitParams{
+		options:  o,
+		logFunc:  logFunc,
+		errFunc:  errFunc,
+		registry: r,
+	}
+
+	tf, ok := transports[o.Transport]
+
+	if !ok {
+		return nil, errors.New("Transports - Transport type not found: " + o.Transport)
+	}
+
+	var capture *capturingTransport
+
+	if o.CaptureFile != "" {
+		capture = &capturingTransport{
+			options: o,
+			logFunc: logFunc,
+			errFunc: errFunc,
+		}
+
+		tip.sentFunc = capture.sent
+	}
+
+	t := tf(tip)
+
+	if o.Netns != "" {
+		t = &namespacedTransport{Transport: t, netns: o.Netns}
+	}
+
+	if capture != nil {
+		capture.Transport = t
+		t = capture
+	}
+
+	return t, nil
+}
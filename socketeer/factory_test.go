@@ -0,0 +1,81 @@
+package socketeer_test
+
+import (
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/socketeer"
+	"github.com/ipchama/dhammer/stats"
+	"net"
+	"testing"
+)
+
+type TestTransport struct {
+}
+
+func (t *TestTransport) Init() error {
+	return nil
+}
+
+func (t *TestTransport) DeInit() error {
+	return nil
+}
+
+func (t *TestTransport) SetReceiver(receiverFunc func(msgs []message.Message) bool) {
+}
+
+func (t *TestTransport) AddPayload(payload []byte) bool {
+	return true
+}
+
+func (t *TestTransport) RunListener() {
+}
+
+func (t *TestTransport) RunWriter() {
+}
+
+func (t *TestTransport) StopListener() error {
+	return nil
+}
+
+func (t *TestTransport) StopWriter() error {
+	return nil
+}
+
+func (t *TestTransport) Options() config.SocketeerOptions {
+	return config.SocketeerOptions{}
+}
+
+func (t *TestTransport) InterfaceInfo() *net.Interface {
+	return nil
+}
+
+func (t *TestTransport) ClaimAddress(ip net.IP) error {
+	return nil
+}
+
+func TestNew(t *testing.T) {
+
+	o := &config.SocketeerOptions{
+		Transport: "__TEST__",
+	}
+
+	if _, err := socketeer.New(o, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err == nil {
+		t.Errorf("Transport factory did not return error for unknown type.")
+	}
+
+	if err := socketeer.AddTransport(o.Transport, func(tip socketeer.TransportInitParams) socketeer.Transport { return &TestTransport{} }); err != nil {
+		t.Errorf("Transport factory failed to add new type.")
+	}
+
+	if err := socketeer.AddTransport(o.Transport, func(tip socketeer.TransportInitParams) socketeer.Transport { return &TestTransport{} }); err == nil {
+		t.Errorf("Transport factory allowed duplicate type.")
+	}
+
+	if _, err := socketeer.New(o, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err != nil {
+		t.Errorf("Transport factory failed to return known type.")
+	}
+
+	if _, err := socketeer.New(&config.SocketeerOptions{Transport: "raw"}, func(string) bool { return true }, func(error) bool { return true }, stats.NewRegistry()); err != nil {
+		t.Errorf("Transport factory did not register the raw socket transport.")
+	}
+}
@@ -0,0 +1,62 @@
+package socketeer
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+/*
+	PACKET_FANOUT:  With more than one RX worker, an extra listener socket is opened for each worker past the first.
+	They're bound to the same interface and joined to one fanout group along with the main socket, and the kernel spreads
+	incoming frames across the group.  Each socket gets its own listener goroutine (and its own RX ring if one is enabled).
+
+	Only the main socket is ever written to.
+
+	The default is lb, round robin.  hash mode hashes on the flow, and broadcast replies from a single server are all
+	the same flow, so they'd all land on one socket.
+
+	The extra sockets are closed by StopListener and released by DeInit along with the main one.
+*/
+
+var fanoutModes = map[string]int{
+	"hash": unix.PACKET_FANOUT_HASH,
+	"lb":   unix.PACKET_FANOUT_LB,
+	"cpu":  unix.PACKET_FANOUT_CPU,
+}
+
+func (s *RawSocketeer) initFanout() error {
+
+	mode, found := fanoutModes[s.options.RxFanoutMode]
+	if !found {
+		return errors.New("Unknown fanout mode: " + s.options.RxFanoutMode)
+	}
+
+	/*
+		Group IDs are per network namespace, so the PID keeps us away from anyone else's group.  A group only takes
+		sockets bound to one interface, so each interface gets its own by adding in the interface index.
+	*/
+	fanoutArg := ((os.Getpid() + s.IfInfo.Index) & 0xffff) | mode<<16
+
+	if err := unix.SetsockoptInt(s.socketFd, unix.SOL_PACKET, unix.PACKET_FANOUT, fanoutArg); err != nil {
+		return err
+	}
+
+	for i := 1; i < s.options.RxWorkers; i++ {
+		l := NewRawSocketeer(s.options, s.addLog, s.addError)
+		l.fanoutMember = true
+		l.wire = s.wire
+
+		if err := l.Init(); err != nil {
+			return err
+		}
+
+		s.fanout = append(s.fanout, l)
+
+		if err := unix.SetsockoptInt(l.socketFd, unix.SOL_PACKET, unix.PACKET_FANOUT, fanoutArg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
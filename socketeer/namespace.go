@@ -0,0 +1,20 @@
+package socketeer
+
+import (
+	"github.com/ipchama/dhammer/namespace"
+)
+
+// namespacedTransport sets up and tears down a transport inside a network namespace.  Sockets stay where they were
+// opened, so nothing else has to know.
+type namespacedTransport struct {
+	Transport
+	netns string
+}
+
+func (t *namespacedTransport) Init() error {
+	return namespace.Do(t.netns, t.Transport.Init)
+}
+
+func (t *namespacedTransport) DeInit() error {
+	return namespace.Do(t.netns, t.Transport.DeInit)
+}
@@ -0,0 +1,178 @@
+package socketeer
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/packet"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	pcap transport:  Everything the generator and handler would have sent is written to a capture file instead of the wire.
+	Files ending in .pcapng are written as pcapng and anything else as plain pcap.
+
+	Nothing is ever received.  If the interface doesn't exist, a made-up one is used, so no interface or privileges are needed.
+*/
+
+const pcapSnapLen = 65536
+
+type pcapPacketWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+type PcapSocketeer struct {
+	file   *os.File
+	writer pcapPacketWriter
+	IfInfo *net.Interface
+
+	outputChannel chan []byte
+
+	options *config.SocketeerOptions
+
+	addLog   func(string) bool
+	addError func(error) bool
+	onSent   sentFunc
+
+	finishChannel chan struct{}
+	writerDone    chan struct{}
+}
+
+func init() {
+	if err := AddTransport("pcap", NewPcapTransport); err != nil {
+		panic(err)
+	}
+}
+
+func NewPcapTransport(tip TransportInitParams) Transport {
+	s := NewPcapSocketeer(tip.options, tip.logFunc, tip.errFunc)
+	s.onSent = tip.sentFunc
+
+	return s
+}
+
+func NewPcapSocketeer(o *config.SocketeerOptions, logFunc func(string) bool, errFunc func(error) bool) *PcapSocketeer {
+
+	s := PcapSocketeer{
+		options:       o,
+		addLog:        logFunc,
+		addError:      errFunc,
+		outputChannel: make(chan []byte, 1000),
+		finishChannel: make(chan struct{}),
+		writerDone:    make(chan struct{}),
+	}
+
+	return &s
+}
+
+func (s *PcapSocketeer) SetReceiver(receiverFunc func(msgs []message.Message) bool) {
+}
+
+func (s *PcapSocketeer) Options() config.SocketeerOptions {
+	return *s.options
+}
+
+func (s *PcapSocketeer) InterfaceInfo() *net.Interface {
+	return s.IfInfo
+}
+
+// ClaimAddress does nothing.  Nothing is ever received.
+func (s *PcapSocketeer) ClaimAddress(ip net.IP) error {
+	return nil
+}
+
+func (s *PcapSocketeer) Init() error {
+	var err error
+
+	if s.IfInfo, err = net.InterfaceByName(s.options.InterfaceName); err != nil || len(s.IfInfo.HardwareAddr) != 6 {
+		s.IfInfo = &net.Interface{
+			Index:        1,
+			MTU:          1500,
+			Name:         s.options.InterfaceName,
+			HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}, // Locally administered.
+		}
+	}
+
+	if s.file, err = os.Create(s.options.PcapFile); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(s.options.PcapFile, ".pcapng") {
+		s.writer, err = pcapgo.NewNgWriter(s.file, layers.LinkTypeEthernet)
+		return err
+	}
+
+	w := pcapgo.NewWriter(s.file)
+	s.writer = w
+
+	return w.WriteFileHeader(pcapSnapLen, layers.LinkTypeEthernet)
+}
+
+func (s *PcapSocketeer) DeInit() error {
+
+	if s.file == nil {
+		return nil
+	}
+
+	var err error
+
+	if ng, ok := s.writer.(*pcapgo.NgWriter); ok {
+		err = ng.Flush()
+	}
+
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	s.addLog("Wrote frames to " + s.options.PcapFile)
+
+	return err
+}
+
+func (s *PcapSocketeer) RunListener() {
+	<-s.finishChannel
+}
+
+func (s *PcapSocketeer) RunWriter() {
+
+	for payload := range s.outputChannel {
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Now(),
+			CaptureLength: len(payload),
+			Length:        len(payload),
+		}
+
+		if err := s.writer.WritePacket(ci, payload); err != nil {
+			s.addError(err)
+		} else {
+			s.onSent.sent(payload)
+		}
+
+		packet.Release(payload)
+	}
+
+	close(s.writerDone)
+}
+
+func (s *PcapSocketeer) StopListener() error {
+	close(s.finishChannel)
+	return nil
+}
+
+// StopWriter waits for everything queued to be written, since DeInit closes the file straight after.
+func (s *PcapSocketeer) StopWriter() error {
+	close(s.outputChannel)
+	<-s.writerDone
+	return nil
+}
+
+func (s *PcapSocketeer) AddPayload(payload []byte) bool {
+	s.outputChannel <- payload
+	return true
+}
@@ -0,0 +1,169 @@
+package socketeer
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/vlan"
+	"golang.org/x/sys/unix"
+	"sync/atomic"
+	"unsafe"
+)
+
+/*
+	PACKET_RX_RING with TPACKET_V3:  The kernel fills fixed-size blocks of frames in memory shared with us and hands over a whole block at a time.
+	That's one poll per block instead of one recvfrom per frame.
+
+	Block layout:
+		tpacket_block_desc { version, offset_to_priv, tpacket_hdr_v1 { block_status, num_pkts, offset_to_first_pkt, ... } }
+		frames, each: tpacket3_hdr, sockaddr_ll, frame data at tp_mac, next frame at tp_next_offset.
+*/
+
+const (
+	rxRingFrameSize      = 2048
+	rxRingPollTimeout    = 100 // ms.  How long to wait for a block before checking for a stop request.
+	blockDescHdrOffset   = 8   // Offset of tpacket_hdr_v1 in tpacket_block_desc.
+	tpacket3HdrAlignment = 16  // TPACKET_ALIGNMENT
+	sockaddrLLOffset     = (unix.SizeofTpacket3Hdr + tpacket3HdrAlignment - 1) &^ (tpacket3HdrAlignment - 1)
+	sllPkttypeOffset     = 10
+)
+
+type rxRing struct {
+	data       []byte
+	blockSize  int
+	blockCount int
+	block      int
+}
+
+func (s *RawSocketeer) initRxRing() error {
+
+	blockSize := s.options.RxRingBlockSize
+	blockCount := s.options.RxRingBlockCount
+
+	if blockSize <= 0 || blockSize%unix.Getpagesize() != 0 || blockSize%rxRingFrameSize != 0 {
+		return errors.New("RX ring block size must be a positive multiple of the page size")
+	}
+
+	if blockCount <= 0 {
+		return errors.New("RX ring block count must be positive")
+	}
+
+	if err := unix.SetsockoptInt(s.socketFd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return err
+	}
+
+	req := unix.TpacketReq3{
+		Block_size:     uint32(blockSize),
+		Block_nr:       uint32(blockCount),
+		Frame_size:     rxRingFrameSize,
+		Frame_nr:       uint32(blockSize / rxRingFrameSize * blockCount),
+		Retire_blk_tov: uint32(s.options.RxRingBlockTimeout),
+	}
+
+	if err := unix.SetsockoptTpacketReq3(s.socketFd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return err
+	}
+
+	data, err := unix.Mmap(s.socketFd, 0, blockSize*blockCount, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_LOCKED|unix.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+
+	s.rxRing = &rxRing{
+		data:       data,
+		blockSize:  blockSize,
+		blockCount: blockCount,
+	}
+
+	return nil
+}
+
+func (s *RawSocketeer) deInitRxRing() error {
+	if s.rxRing == nil {
+		return nil
+	}
+
+	err := unix.Munmap(s.rxRing.data)
+	s.rxRing = nil
+
+	return err
+}
+
+func (s *RawSocketeer) runRxRingListener() {
+
+	r := s.rxRing
+
+	pollFds := []unix.PollFd{{Fd: int32(s.socketFd), Events: unix.POLLIN | unix.POLLERR}}
+
+	for {
+
+		select {
+		case _, _ = <-s.finishChannel:
+			close(s.doneChannel)
+			return
+		default:
+		}
+
+		block := r.data[r.block*r.blockSize : (r.block+1)*r.blockSize]
+		hdr := (*unix.TpacketHdrV1)(unsafe.Pointer(&block[blockDescHdrOffset]))
+
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			if _, err := unix.Poll(pollFds, rxRingPollTimeout); err != nil && err != unix.EINTR {
+				s.addError(err)
+			}
+			continue
+		}
+
+		if msgs := s.readBlock(block, hdr); len(msgs) > 0 {
+			s.handleMessages(msgs)
+		}
+
+		// Give the block back to the kernel.
+		atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+
+		if r.block++; r.block == r.blockCount {
+			r.block = 0
+		}
+	}
+}
+
+// readBlock copies every incoming frame in the block into a single buffer, since the block goes back to the kernel before the handler gets to the frames.
+func (s *RawSocketeer) readBlock(block []byte, hdr *unix.TpacketHdrV1) []message.Message {
+
+	numPkts := int(hdr.Num_pkts)
+
+	msgs := make([]message.Message, 0, numPkts)
+	buf := make([]byte, 0, int(hdr.Blk_len)+numPkts*4) // Room for putting back stripped VLAN tags.
+
+	offset := int(hdr.Offset_to_first_pkt)
+
+	for i := 0; i < numPkts; i++ {
+		pkt := (*unix.Tpacket3Hdr)(unsafe.Pointer(&block[offset]))
+
+		if block[offset+sockaddrLLOffset+sllPkttypeOffset] != unix.PACKET_OUTGOING && pkt.Snaplen > 0 {
+			start := len(buf)
+			frame := block[offset+int(pkt.Mac) : offset+int(pkt.Mac)+int(pkt.Snaplen)]
+
+			if pkt.Status&unix.TP_STATUS_VLAN_VALID != 0 { // Put back the tag the kernel stripped.
+				tpid := uint16(0)
+				if pkt.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+					tpid = pkt.Hv1.Vlan_tpid
+				}
+				buf = vlan.AppendTagged(buf, frame, tpid, uint16(pkt.Hv1.Vlan_tci))
+			} else {
+				buf = append(buf, frame...)
+			}
+
+			s.wire.received(1, len(frame))
+
+			msgs = append(msgs, message.Message{
+				Packet: gopacket.NewPacket(buf[start:len(buf):len(buf)], layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true}),
+			})
+		}
+
+		offset += int(pkt.Next_offset)
+	}
+
+	return msgs
+}
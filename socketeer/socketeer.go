@@ -6,15 +6,21 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/ipchama/dhammer/config"
 	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/packet"
+	"github.com/ipchama/dhammer/stats"
+	"github.com/ipchama/dhammer/vlan"
 	"golang.org/x/sys/unix"
 	"net"
 	"runtime"
 	"syscall"
+	"unsafe"
 )
 
 // TODO:	Move syscalls from syscall package to golang.org/x/sys/unix.
 //			Maybe add custom port to ebpf rules.
 
+const sizeofTpacketAuxdata = int(unsafe.Sizeof(unix.TpacketAuxdata{}))
+
 type RawSocketeer struct {
 	socketFd      int
 	IfInfo        *net.Interface
@@ -25,10 +31,39 @@ type RawSocketeer struct {
 	addLog   func(string) bool
 	addError func(error) bool
 
-	handleMessage func(msg message.Message) bool
+	handleMessages func(msgs []message.Message) bool
 
 	finishChannel chan struct{}
 	doneChannel   chan struct{}
+
+	rxRing *rxRing
+
+	fanout       []*RawSocketeer // Extra listener sockets in the same fanout group.
+	fanoutMember bool
+	closed       bool // StopListener already closed the socket.
+
+	registry     *stats.Registry
+	txBatchSizes *stats.Histogram
+	onSent       sentFunc
+
+	wire              *wireStats
+	socketStatsFinish chan struct{}
+	socketStatsDone   chan struct{}
+}
+
+func init() {
+	if err := AddTransport("raw", NewRawTransport); err != nil {
+		panic(err)
+	}
+}
+
+func NewRawTransport(tip TransportInitParams) Transport {
+	s := NewRawSocketeer(tip.options, tip.logFunc, tip.errFunc)
+	s.registry = tip.registry
+	s.wire = newWireStats(tip.registry)
+	s.onSent = tip.sentFunc
+
+	return s
 }
 
 func NewRawSocketeer(o *config.SocketeerOptions, logFunc func(string) bool, errFunc func(error) bool) *RawSocketeer {
@@ -37,7 +72,7 @@ func NewRawSocketeer(o *config.SocketeerOptions, logFunc func(string) bool, errF
 		options:       o,
 		addLog:        logFunc,
 		addError:      errFunc,
-		outputChannel: make(chan []byte),
+		outputChannel: make(chan []byte, o.TxBatchSize),
 		finishChannel: make(chan struct{}, 1),
 		doneChannel:   make(chan struct{}, 1),
 	}
@@ -45,8 +80,12 @@ func NewRawSocketeer(o *config.SocketeerOptions, logFunc func(string) bool, errF
 	return &s
 }
 
-func (s *RawSocketeer) SetReceiver(receiverFunc func(msg message.Message) bool) {
-	s.handleMessage = receiverFunc
+func (s *RawSocketeer) SetReceiver(receiverFunc func(msgs []message.Message) bool) {
+	s.handleMessages = receiverFunc
+
+	for _, l := range s.fanout {
+		l.SetReceiver(receiverFunc)
+	}
 }
 
 func (s *RawSocketeer) Options() config.SocketeerOptions {
@@ -54,13 +93,34 @@ func (s *RawSocketeer) Options() config.SocketeerOptions {
 	return *s.options // Wishful thinking... The struct holds pointers anyway.  Decide how to deal with this later.
 }
 
+func (s *RawSocketeer) InterfaceInfo() *net.Interface {
+	return s.IfInfo
+}
+
+// ClaimAddress does nothing.  The socket filter lets ARP through, so there is nothing to claim.
+func (s *RawSocketeer) ClaimAddress(ip net.IP) error {
+	return nil
+}
+
 func (s *RawSocketeer) Init() error {
 	var err error
 
+	if s.registry != nil && s.options.TxBatchSize > 1 {
+		s.txBatchSizes = s.registry.Histogram("TxBatchSize", TxBatchSizeBuckets)
+	}
+
 	if s.socketFd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, syscall.ETH_P_ALL); err != nil {
 		return err
 	}
 
+	if err = setBufferSize(s.socketFd, unix.SO_RCVBUF, unix.SO_RCVBUFFORCE, s.options.RcvBuf, "SO_RCVBUF", s.addLog); err != nil {
+		return err
+	}
+
+	if err = setBufferSize(s.socketFd, unix.SO_SNDBUF, unix.SO_SNDBUFFORCE, s.options.SndBuf, "SO_SNDBUF", s.addLog); err != nil {
+		return err
+	}
+
 	if s.options.EbpfFilter != nil {
 		err = unix.SetsockoptSockFprog(s.socketFd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, s.options.EbpfFilter)
 		if err != nil {
@@ -68,6 +128,14 @@ func (s *RawSocketeer) Init() error {
 		}
 	}
 
+	if s.options.RxRing {
+		if err = s.initRxRing(); err != nil {
+			return err
+		}
+	} else if err = unix.SetsockoptInt(s.socketFd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil { // For VLAN tags the kernel strips.
+		return err
+	}
+
 	s.IfInfo, err = net.InterfaceByName(s.options.InterfaceName)
 
 	if err != nil {
@@ -91,6 +159,18 @@ func (s *RawSocketeer) Init() error {
 		return err
 	}
 
+	s.startSocketStats()
+
+	if s.fanoutMember {
+		return nil
+	}
+
+	if s.options.RxWorkers > 1 {
+		if err = s.initFanout(); err != nil {
+			return err
+		}
+	}
+
 	if s.options.PromiscuousMode {
 		if err = syscall.SetLsfPromisc(s.options.InterfaceName, true); err != nil {
 			return err
@@ -102,12 +182,23 @@ func (s *RawSocketeer) Init() error {
 
 func (s *RawSocketeer) DeInit() error {
 
-	if s.options.PromiscuousMode {
+	for _, l := range s.fanout {
+		if err := l.DeInit(); err != nil {
+			return err
+		}
+	}
+
+	if s.options.PromiscuousMode && !s.fanoutMember {
 		if err := syscall.SetLsfPromisc(s.options.InterfaceName, false); err != nil {
 			return err
 		}
 	}
 
+	// The fd number may already belong to something else by now.
+	if s.closed {
+		return nil
+	}
+
 	if err := syscall.Close(s.socketFd); err != nil {
 		return err
 	}
@@ -117,7 +208,17 @@ func (s *RawSocketeer) DeInit() error {
 
 func (s *RawSocketeer) RunListener() {
 
+	for _, l := range s.fanout {
+		go l.RunListener()
+	}
+
+	if s.rxRing != nil {
+		s.runRxRingListener()
+		return
+	}
+
 	data := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(sizeofTpacketAuxdata))
 
 	for {
 
@@ -128,12 +229,12 @@ func (s *RawSocketeer) RunListener() {
 		default:
 		}
 
-		read, ifrom, err := syscall.Recvfrom(s.socketFd, data, 0)
+		read, oobRead, _, ifrom, err := unix.Recvmsg(s.socketFd, data, oob, 0)
 
 		if err != nil {
 			s.addError(err)
 			continue
-		} else if sll := ifrom.(*syscall.SockaddrLinklayer); sll.Pkttype == syscall.PACKET_OUTGOING {
+		} else if sll, ok := ifrom.(*unix.SockaddrLinklayer); ok && sll.Pkttype == unix.PACKET_OUTGOING {
 			runtime.Gosched()
 			continue
 		} else if read == 0 {
@@ -141,19 +242,61 @@ func (s *RawSocketeer) RunListener() {
 			continue
 		}
 
-		p := gopacket.NewPacket(data[:read], layers.LayerTypeEthernet, gopacket.Lazy)
+		s.wire.received(1, read)
+
+		frame := data[:read]
+
+		if tpid, tci, tagged := strippedVlanTag(oob[:oobRead]); tagged {
+			frame = vlan.AppendTagged(make([]byte, 0, read+4), frame, tpid, tci)
+		}
+
+		p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
 
 		msg := message.Message{
 			Packet: p,
 		}
 
-		s.handleMessage(msg) // Such an urge to use a reference here...
+		s.handleMessages([]message.Message{msg}) // Such an urge to use a reference here...
 	}
 
 }
 
+// strippedVlanTag digs the VLAN tag the kernel took off the frame out of the PACKET_AUXDATA control message.
+func strippedVlanTag(oob []byte) (tpid uint16, tci uint16, tagged bool) {
+
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level != unix.SOL_PACKET || cmsg.Header.Type != unix.PACKET_AUXDATA || len(cmsg.Data) < sizeofTpacketAuxdata {
+			continue
+		}
+
+		aux := (*unix.TpacketAuxdata)(unsafe.Pointer(&cmsg.Data[0]))
+
+		if aux.Status&unix.TP_STATUS_VLAN_VALID == 0 {
+			return 0, 0, false
+		}
+
+		if aux.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tpid = aux.Vlan_tpid
+		}
+
+		return tpid, aux.Vlan_tci, true
+	}
+
+	return 0, 0, false
+}
+
 func (s *RawSocketeer) RunWriter() {
 
+	if s.options.TxBatchSize > 1 {
+		s.runBatchWriter()
+		return
+	}
+
 	var payload []byte
 
 	for ok := true; ok; {
@@ -162,19 +305,38 @@ func (s *RawSocketeer) RunWriter() {
 			_, err := syscall.Write(s.socketFd, payload)
 
 			if err != nil {
+				s.wire.writeError(err)
 				s.addError(err)
+			} else {
+				s.wire.sent(1, len(payload))
+				s.onSent.sent(payload)
 			}
+
+			packet.Release(payload)
 		}
 	}
 }
 
 func (s *RawSocketeer) StopListener() error {
 
+	s.stopSocketStats()
+
 	err := syscall.Close(s.socketFd)
+	s.closed = true
 
 	s.finishChannel <- struct{}{}
 	_, _ = <-s.doneChannel
 
+	if ringErr := s.deInitRxRing(); err == nil {
+		err = ringErr
+	}
+
+	for _, l := range s.fanout {
+		if fanoutErr := l.StopListener(); err == nil {
+			err = fanoutErr
+		}
+	}
+
 	return err
 }
 
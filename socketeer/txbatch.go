@@ -0,0 +1,135 @@
+package socketeer
+
+import (
+	"github.com/ipchama/dhammer/packet"
+	"golang.org/x/sys/unix"
+	"time"
+	"unsafe"
+)
+
+/*
+	Batched writes:  The writer waits for one payload, then keeps collecting until it has a full batch or the flush interval runs out,
+	and sends the whole batch with a single sendmmsg.
+*/
+
+// mmsghdr mirrors struct mmsghdr, which x/sys/unix doesn't define.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// TxBatchSizeBuckets are the histogram bounds for the achieved batch sizes.
+var TxBatchSizeBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+type txBatch struct {
+	payloads [][]byte
+	iovecs   []unix.Iovec
+	msgs     []mmsghdr
+}
+
+func newTxBatch(size int) *txBatch {
+	return &txBatch{
+		payloads: make([][]byte, 0, size),
+		iovecs:   make([]unix.Iovec, size),
+		msgs:     make([]mmsghdr, size),
+	}
+}
+
+func (s *RawSocketeer) runBatchWriter() {
+
+	b := newTxBatch(s.options.TxBatchSize)
+
+	flushTimer := time.NewTimer(time.Hour)
+	flushTimer.Stop()
+
+	for {
+		payload, ok := <-s.outputChannel
+		if !ok {
+			return
+		}
+
+		b.payloads = append(b.payloads[:0], payload)
+
+		if s.options.TxFlushInterval > 0 {
+			flushTimer.Reset(s.options.TxFlushInterval)
+		}
+
+		timedOut := false
+
+	fill:
+		for len(b.payloads) < s.options.TxBatchSize {
+			if s.options.TxFlushInterval > 0 {
+				select {
+				case payload, ok = <-s.outputChannel:
+				case <-flushTimer.C:
+					timedOut = true
+					break fill
+				}
+			} else {
+				select {
+				case payload, ok = <-s.outputChannel:
+				default:
+					break fill
+				}
+			}
+
+			if !ok {
+				s.sendBatch(b)
+				return
+			}
+
+			b.payloads = append(b.payloads, payload)
+		}
+
+		if s.options.TxFlushInterval > 0 && !timedOut && !flushTimer.Stop() {
+			<-flushTimer.C
+		}
+
+		s.sendBatch(b)
+	}
+}
+
+func (s *RawSocketeer) sendBatch(b *txBatch) {
+
+	count := len(b.payloads)
+
+	if s.txBatchSizes != nil {
+		s.txBatchSizes.Observe(float64(count))
+	}
+
+	for i, payload := range b.payloads {
+		b.iovecs[i].Base = &payload[0]
+		b.iovecs[i].SetLen(len(payload))
+		b.msgs[i].hdr.Iov = &b.iovecs[i]
+		b.msgs[i].hdr.SetIovlen(1)
+	}
+
+	for sent := 0; sent < count; {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(s.socketFd), uintptr(unsafe.Pointer(&b.msgs[sent])), uintptr(count-sent), 0, 0, 0)
+
+		if errno == unix.EINTR {
+			continue
+		} else if errno != 0 {
+			s.wire.writeError(errno)
+			s.addError(errno)
+			sent++ // Skip the frame that failed and carry on with the rest.
+			continue
+		}
+
+		bytes := 0
+		for _, payload := range b.payloads[sent : sent+int(n)] {
+			bytes += len(payload)
+			s.onSent.sent(payload)
+		}
+		s.wire.sent(int(n), bytes)
+
+		sent += int(n)
+	}
+
+	// Don't hold on to payloads between batches.
+	for i := range b.payloads {
+		packet.Release(b.payloads[i])
+		b.payloads[i] = nil
+		b.iovecs[i].Base = nil
+	}
+}
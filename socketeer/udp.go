@@ -0,0 +1,270 @@
+package socketeer
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/packet"
+	"net"
+	"time"
+)
+
+/*
+	UDP transport:  A relay only ever talks UDP from port 67 to the server, so in relay mode the kernel can do the rest.
+	No raw sockets (so no CAP_NET_RAW) and no gateway MAC.  Binding port 67 does still need CAP_NET_BIND_SERVICE,
+	unless net.ipv4.ip_unprivileged_port_start allows it.
+
+	The generator and handler keep building whole frames.  The writer takes the UDP payload and destination out of each
+	frame and sends that, and the listener wraps each datagram in made-up Ethernet/IPv4/UDP headers so it looks
+	like any other received frame.  Anything that isn't IPv4/UDP (ARP replies, for instance) can't be sent and is dropped.
+*/
+
+const relayPort = 67
+
+type UdpSocketeer struct {
+	conn          *net.UDPConn
+	IfInfo        *net.Interface
+	outputChannel chan []byte
+
+	options *config.SocketeerOptions
+
+	addLog   func(string) bool
+	addError func(error) bool
+
+	handleMessages func(msgs []message.Message) bool
+	onSent         sentFunc
+
+	finishChannel chan struct{}
+	doneChannel   chan struct{}
+}
+
+func init() {
+	if err := AddTransport("udp", NewUdpTransport); err != nil {
+		panic(err)
+	}
+}
+
+func NewUdpTransport(tip TransportInitParams) Transport {
+	s := NewUdpSocketeer(tip.options, tip.logFunc, tip.errFunc)
+	s.onSent = tip.sentFunc
+
+	return s
+}
+
+func NewUdpSocketeer(o *config.SocketeerOptions, logFunc func(string) bool, errFunc func(error) bool) *UdpSocketeer {
+
+	s := UdpSocketeer{
+		options:       o,
+		addLog:        logFunc,
+		addError:      errFunc,
+		outputChannel: make(chan []byte, o.TxBatchSize),
+		finishChannel: make(chan struct{}, 1),
+		doneChannel:   make(chan struct{}, 1),
+	}
+
+	return &s
+}
+
+func (s *UdpSocketeer) SetReceiver(receiverFunc func(msgs []message.Message) bool) {
+	s.handleMessages = receiverFunc
+}
+
+func (s *UdpSocketeer) Options() config.SocketeerOptions {
+	return *s.options
+}
+
+func (s *UdpSocketeer) InterfaceInfo() *net.Interface {
+	return s.IfInfo
+}
+
+// ClaimAddress does nothing.  The kernel answers ARP for a UDP socket.
+func (s *UdpSocketeer) ClaimAddress(ip net.IP) error {
+	return nil
+}
+
+func (s *UdpSocketeer) Init() error {
+	var err error
+
+	if s.options.UdpSourceIP == nil {
+		return errors.New("The udp transport only works in relay mode")
+	}
+
+	if s.IfInfo, err = net.InterfaceByName(s.options.InterfaceName); err != nil {
+		return err
+	}
+
+	// Loopback and the like have no MAC, which gopacket won't serialize.  It never hits the wire anyway.
+	if len(s.IfInfo.HardwareAddr) != 6 {
+		iface := *s.IfInfo
+		iface.HardwareAddr = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+		s.IfInfo = &iface
+	}
+
+	if s.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: s.options.UdpSourceIP, Port: relayPort}); err != nil {
+		return err
+	}
+
+	// These are capped by net.core.rmem_max/wmem_max.
+	if s.options.RcvBuf > 0 {
+		if err = s.conn.SetReadBuffer(s.options.RcvBuf); err != nil {
+			return err
+		}
+	}
+
+	if s.options.SndBuf > 0 {
+		if err = s.conn.SetWriteBuffer(s.options.SndBuf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *UdpSocketeer) DeInit() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *UdpSocketeer) RunListener() {
+
+	data := make([]byte, 4096)
+	localIP := s.options.UdpSourceIP.To4()
+
+	goPacketSerializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	for {
+
+		select {
+		case _, _ = <-s.finishChannel:
+			close(s.doneChannel)
+			return
+		default:
+		}
+
+		read, from, err := s.conn.ReadFromUDP(data)
+
+		if err != nil {
+			// StopListener breaks us out of the read with a deadline.
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				s.addError(err)
+			}
+			continue
+		}
+
+		ethernetLayer := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 0},
+			DstMAC:       s.IfInfo.HardwareAddr,
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+
+		ipLayer := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    from.IP.To4(),
+			DstIP:    localIP,
+		}
+
+		udpLayer := &layers.UDP{
+			SrcPort: layers.UDPPort(from.Port),
+			DstPort: relayPort,
+		}
+
+		udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+		buf := gopacket.NewSerializeBuffer()
+
+		if err = gopacket.SerializeLayers(buf, goPacketSerializeOpts, ethernetLayer, ipLayer, udpLayer, gopacket.Payload(data[:read])); err != nil {
+			s.addError(err)
+			continue
+		}
+
+		msg := message.Message{
+			Packet: gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Lazy),
+		}
+
+		s.handleMessages([]message.Message{msg})
+	}
+}
+
+func (s *UdpSocketeer) RunWriter() {
+
+	for payload := range s.outputChannel {
+
+		dst, udpPayload, ok := unwrapUDP(payload)
+		if !ok {
+			packet.Release(payload)
+			continue
+		}
+
+		if _, err := s.conn.WriteToUDP(udpPayload, dst); err != nil {
+			s.addError(err)
+		} else {
+			s.onSent.sent(payload)
+		}
+
+		packet.Release(payload)
+	}
+}
+
+// unwrapUDP returns the destination and payload of an Ethernet/IPv4/UDP frame.
+func unwrapUDP(frame []byte) (*net.UDPAddr, []byte, bool) {
+
+	const ipOffset = 14
+
+	if len(frame) < ipOffset+20 || binary.BigEndian.Uint16(frame[12:14]) != uint16(layers.EthernetTypeIPv4) {
+		return nil, nil, false
+	}
+
+	ipHeaderLen := int(frame[ipOffset]&0x0f) * 4
+	udpOffset := ipOffset + ipHeaderLen
+
+	if frame[ipOffset+9] != uint8(layers.IPProtocolUDP) || len(frame) < udpOffset+8 {
+		return nil, nil, false
+	}
+
+	dst := &net.UDPAddr{
+		IP:   net.IP(frame[ipOffset+16 : ipOffset+20]),
+		Port: int(binary.BigEndian.Uint16(frame[udpOffset+2 : udpOffset+4])),
+	}
+
+	udpEnd := udpOffset + int(binary.BigEndian.Uint16(frame[udpOffset+4:udpOffset+6]))
+	if udpEnd > len(frame) || udpEnd < udpOffset+8 {
+		return nil, nil, false
+	}
+
+	return dst, frame[udpOffset+8 : udpEnd], true
+}
+
+func (s *UdpSocketeer) StopListener() error {
+
+	s.finishChannel <- struct{}{}
+
+	// The writer might still be sending, so the socket stays open until DeInit.
+	err := s.conn.SetReadDeadline(time.Now())
+
+	_, _ = <-s.doneChannel
+
+	return err
+}
+
+func (s *UdpSocketeer) StopWriter() error {
+	close(s.outputChannel)
+	return nil
+}
+
+// AddPayload only queues frames the writer can actually send, so the caller doesn't count ARP replies and the like as sent.
+func (s *UdpSocketeer) AddPayload(payload []byte) bool {
+	if _, _, ok := unwrapUDP(payload); !ok {
+		packet.Release(payload)
+		return false
+	}
+
+	s.outputChannel <- payload
+	return true
+}
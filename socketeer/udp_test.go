@@ -0,0 +1,77 @@
+package socketeer
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+func TestUnwrapUDP(t *testing.T) {
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	ipLayer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+
+	udpLayer := &layers.UDP{
+		SrcPort: 67,
+		DstPort: 6767,
+	}
+
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ethernetLayer, ipLayer, udpLayer, gopacket.Payload([]byte("payload"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pad it out like a short frame would be on the wire.
+	frame := append(buf.Bytes(), make([]byte, 10)...)
+
+	dst, payload, ok := unwrapUDP(frame)
+
+	if !ok {
+		t.Fatalf("Failed to unwrap a UDP frame.")
+	}
+
+	if !dst.IP.Equal(net.IPv4(10, 0, 0, 2)) || dst.Port != 6767 {
+		t.Errorf("Wrong destination: %v", dst)
+	}
+
+	if string(payload) != "payload" {
+		t.Errorf("Wrong payload: %q", payload)
+	}
+
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   ethernetLayer.SrcMAC,
+		SourceProtAddress: []byte{10, 0, 0, 1},
+		DstHwAddress:      ethernetLayer.SrcMAC,
+		DstProtAddress:    []byte{10, 0, 0, 2},
+	}
+
+	ethernetLayer.EthernetType = layers.EthernetTypeARP
+
+	buf = gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ethernetLayer, arpLayer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := unwrapUDP(buf.Bytes()); ok {
+		t.Errorf("Unwrapped an ARP frame.")
+	}
+}
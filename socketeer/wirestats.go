@@ -0,0 +1,183 @@
+package socketeer
+
+import (
+	"github.com/ipchama/dhammer/stats"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/*
+	Wire-level stats for AF_PACKET sockets:  Frames and bytes each way, write errors by errno, and what the kernel says it
+	queued and dropped for us.  Kernel drops mean the receive buffer (or RX ring) overflowed, so those replies never made
+	it to the handler and would otherwise look like the server not answering.
+
+	PACKET_STATISTICS resets every time it's read, so each socket polls it on its own and adds what it gets to the counters.
+*/
+
+const socketStatsInterval = time.Second
+
+type wireStats struct {
+	txFrames *stats.Counter
+	txBytes  *stats.Counter
+	txErrors *stats.Counter
+	rxFrames *stats.Counter
+	rxBytes  *stats.Counter
+
+	kernelRxPackets *stats.Counter
+	kernelRxDrops   *stats.Counter
+	kernelRxFreezes *stats.Counter
+}
+
+// newWireStats returns nil without a registry, and a nil wireStats counts nothing.
+func newWireStats(r *stats.Registry) *wireStats {
+
+	if r == nil {
+		return nil
+	}
+
+	return &wireStats{
+		txFrames:        r.Counter("TxFrames"),
+		txBytes:         r.Counter("TxBytes"),
+		txErrors:        r.Counter("TxErrors"),
+		rxFrames:        r.Counter("RxFrames"),
+		rxBytes:         r.Counter("RxBytes"),
+		kernelRxPackets: r.Counter("KernelRxPackets"),
+		kernelRxDrops:   r.Counter("KernelRxDrops"),
+		kernelRxFreezes: r.Counter("KernelRxQueueFreezes"),
+	}
+}
+
+func (w *wireStats) sent(frames int, bytes int) {
+	if w == nil {
+		return
+	}
+
+	w.txFrames.Add(frames)
+	w.txBytes.Add(bytes)
+}
+
+func (w *wireStats) received(frames int, bytes int) {
+	if w == nil {
+		return
+	}
+
+	w.rxFrames.Add(frames)
+	w.rxBytes.Add(bytes)
+}
+
+// writeError counts a failed write under its errno, e.g. ENOBUFS when the qdisc or driver queue is full.
+func (w *wireStats) writeError(err error) {
+	if w == nil {
+		return
+	}
+
+	w.txErrors.Inc()
+	w.txErrors.IncBy("errno", errnoName(err))
+}
+
+func errnoName(err error) string {
+
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return "other"
+	}
+
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+
+	return strconv.Itoa(int(errno))
+}
+
+// startSocketStats polls PACKET_STATISTICS until stopSocketStats.
+func (s *RawSocketeer) startSocketStats() {
+
+	if s.wire == nil {
+		return
+	}
+
+	s.socketStatsFinish = make(chan struct{})
+	s.socketStatsDone = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(socketStatsInterval)
+		defer ticker.Stop()
+		defer close(s.socketStatsDone)
+
+		for {
+			select {
+			case <-s.socketStatsFinish:
+				s.readSocketStats() // Whatever came in since the last tick.
+				return
+			case <-ticker.C:
+				s.readSocketStats()
+			}
+		}
+	}()
+}
+
+// stopSocketStats has to be called while the socket is still open.
+func (s *RawSocketeer) stopSocketStats() {
+
+	if s.socketStatsFinish == nil {
+		return
+	}
+
+	close(s.socketStatsFinish)
+	<-s.socketStatsDone
+
+	s.socketStatsFinish = nil
+}
+
+func (s *RawSocketeer) readSocketStats() {
+
+	// The ring switches the socket to TPACKET_V3, which reports queue freezes as well.
+	if s.rxRing != nil {
+		st, err := unix.GetsockoptTpacketStatsV3(s.socketFd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+		if err != nil {
+			s.addError(err)
+			return
+		}
+
+		s.wire.kernelRxPackets.Add(int(st.Packets))
+		s.wire.kernelRxDrops.Add(int(st.Drops))
+		s.wire.kernelRxFreezes.Add(int(st.Freeze_q_cnt))
+
+		return
+	}
+
+	st, err := unix.GetsockoptTpacketStats(s.socketFd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		s.addError(err)
+		return
+	}
+
+	s.wire.kernelRxPackets.Add(int(st.Packets))
+	s.wire.kernelRxDrops.Add(int(st.Drops))
+}
+
+// setBufferSize sets SO_RCVBUF or SO_SNDBUF.  The FORCE variant gets past net.core.rmem_max/wmem_max, but needs
+// CAP_NET_ADMIN, so without it the size is capped and we say what we ended up with.
+func setBufferSize(fd int, opt int, forceOpt int, size int, name string, logFunc func(string) bool) error {
+
+	if size <= 0 {
+		return nil
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, forceOpt, size); err == nil {
+		return nil
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size); err != nil {
+		return err
+	}
+
+	// The kernel doubles what it's given for its own bookkeeping.
+	if actual, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, opt); err == nil && actual < size*2 {
+		logFunc(name + " capped at " + strconv.Itoa(actual/2) + " bytes by the sysctl limit.  Run with CAP_NET_ADMIN to go past it.")
+	}
+
+	return nil
+}
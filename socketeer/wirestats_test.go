@@ -0,0 +1,41 @@
+package socketeer
+
+import (
+	"errors"
+	"github.com/ipchama/dhammer/stats"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+func TestWireStats(t *testing.T) {
+
+	var w *wireStats // What the arp probe gets, with no registry.
+
+	w.sent(1, 100)
+	w.writeError(unix.ENOBUFS)
+
+	registry := stats.NewRegistry()
+	w = newWireStats(registry)
+
+	w.sent(2, 600)
+	w.received(1, 342)
+	w.writeError(unix.ENOBUFS)
+	w.writeError(unix.ENOBUFS)
+	w.writeError(errors.New("not an errno"))
+
+	if registry.Counter("TxFrames").Value() != 2 || registry.Counter("TxBytes").Value() != 600 {
+		t.Errorf("Unexpected TX counts %d/%d", registry.Counter("TxFrames").Value(), registry.Counter("TxBytes").Value())
+	}
+
+	if registry.Counter("RxFrames").Value() != 1 || registry.Counter("RxBytes").Value() != 342 {
+		t.Errorf("Unexpected RX counts %d/%d", registry.Counter("RxFrames").Value(), registry.Counter("RxBytes").Value())
+	}
+
+	if registry.Counter("TxErrors").Value() != 3 {
+		t.Errorf("Unexpected error count %d", registry.Counter("TxErrors").Value())
+	}
+
+	if errnoName(unix.ENOBUFS) != "ENOBUFS" {
+		t.Errorf("Unexpected errno name %s", errnoName(unix.ENOBUFS))
+	}
+}
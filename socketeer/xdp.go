@@ -0,0 +1,589 @@
+package socketeer
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipchama/dhammer/config"
+	"github.com/ipchama/dhammer/message"
+	"github.com/ipchama/dhammer/packet"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+/*
+	AF_XDP:  Frames live in a chunk of memory (the UMEM) shared with the kernel, and four rings pass frame addresses
+	back and forth:
+
+		fill		us -> kernel	empty frames the kernel can receive into
+		rx			kernel -> us	received frames
+		tx			us -> kernel	frames to send
+		completion	kernel -> us	sent frames that can be reused
+
+	The first half of the UMEM is for receiving and the second half for sending, and each ring is sized to its half
+	so it can never overflow.
+
+	An XDP program (see xdpprog.go) steers DHCP replies on the configured queue into the socket.  Everything else goes
+	on to the kernel as usual.  Zero-copy is tried first, and copy mode is used when the driver doesn't support it (veth, for one).
+
+	If any of that fails, the "xdp" transport falls back to raw sockets.
+*/
+
+const xdpFrameSize = 2048
+
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+}
+
+func (r *xdpRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(uintptr(r.descs) + uintptr(i&r.mask)*8))
+}
+
+func (r *xdpRing) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Pointer(uintptr(r.descs) + uintptr(i&r.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+type XdpSocketeer struct {
+	socketFd      int
+	IfInfo        *net.Interface
+	outputChannel chan []byte
+
+	options *config.SocketeerOptions
+
+	addLog   func(string) bool
+	addError func(error) bool
+
+	handleMessages func(msgs []message.Message) bool
+	onSent         sentFunc
+
+	finishChannel chan struct{}
+	doneChannel   chan struct{}
+
+	link       netlink.Link
+	xdpFlags   int
+	attached   bool
+	promisc    bool
+	progFd     int
+	mapFd      int
+	arpMapFd   int
+	zeroCopy   bool
+	frameCount int
+
+	umem []byte
+	fill *xdpRing
+	comp *xdpRing
+	rx   *xdpRing
+	tx   *xdpRing
+
+	txFree []uint64
+}
+
+func init() {
+	if err := AddTransport("xdp", NewXdpTransport); err != nil {
+		panic(err)
+	}
+}
+
+// xdpTransport starts out as AF_XDP and swaps itself for a raw socket transport if AF_XDP can't be set up.
+type xdpTransport struct {
+	Transport
+	tip TransportInitParams
+}
+
+func NewXdpTransport(tip TransportInitParams) Transport {
+	s := NewXdpSocketeer(tip.options, tip.logFunc, tip.errFunc)
+	s.onSent = tip.sentFunc
+
+	return &xdpTransport{
+		Transport: s,
+		tip:       tip,
+	}
+}
+
+func (t *xdpTransport) Init() error {
+
+	err := t.Transport.Init()
+	if err == nil {
+		return nil
+	}
+
+	t.tip.logFunc("AF_XDP unavailable, falling back to raw sockets: " + err.Error())
+
+	if deInitErr := t.Transport.DeInit(); deInitErr != nil {
+		t.tip.errFunc(deInitErr)
+	}
+
+	t.Transport = NewRawTransport(t.tip)
+
+	return t.Transport.Init()
+}
+
+func NewXdpSocketeer(o *config.SocketeerOptions, logFunc func(string) bool, errFunc func(error) bool) *XdpSocketeer {
+
+	s := XdpSocketeer{
+		socketFd:      -1,
+		progFd:        -1,
+		mapFd:         -1,
+		arpMapFd:      -1,
+		options:       o,
+		addLog:        logFunc,
+		addError:      errFunc,
+		outputChannel: make(chan []byte, o.TxBatchSize),
+		finishChannel: make(chan struct{}, 1),
+		doneChannel:   make(chan struct{}, 1),
+	}
+
+	return &s
+}
+
+func (s *XdpSocketeer) SetReceiver(receiverFunc func(msgs []message.Message) bool) {
+	s.handleMessages = receiverFunc
+}
+
+func (s *XdpSocketeer) Options() config.SocketeerOptions {
+	return *s.options
+}
+
+func (s *XdpSocketeer) InterfaceInfo() *net.Interface {
+	return s.IfInfo
+}
+
+// ClaimAddress lets ARP requests for ip through to the socket, if we're redirecting ARP at all.
+func (s *XdpSocketeer) ClaimAddress(ip net.IP) error {
+
+	ip4 := ip.To4()
+
+	if s.arpMapFd < 0 || ip4 == nil {
+		return nil
+	}
+
+	var key [4]byte
+	copy(key[:], ip4)
+
+	return addArpAddress(s.arpMapFd, key)
+}
+
+func (s *XdpSocketeer) Init() error {
+	var err error
+
+	s.frameCount = s.options.XdpFrameCount
+
+	if s.frameCount < 2 || s.frameCount&(s.frameCount-1) != 0 {
+		return errors.New("XDP frame count must be a power of 2")
+	}
+
+	if s.IfInfo, err = net.InterfaceByName(s.options.InterfaceName); err != nil {
+		return err
+	}
+
+	if s.link, err = netlink.LinkByName(s.options.InterfaceName); err != nil {
+		return err
+	}
+
+	if s.socketFd, err = unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0); err != nil {
+		return err
+	}
+
+	if err = s.initUmem(); err != nil {
+		return err
+	}
+
+	if err = s.initRings(); err != nil {
+		return err
+	}
+
+	if err = s.bind(); err != nil {
+		return err
+	}
+
+	if s.mapFd, err = createXskMap(s.options.XdpQueueID + 1); err != nil {
+		return err
+	}
+
+	if err = updateXskMap(s.mapFd, s.options.XdpQueueID, s.socketFd); err != nil {
+		return err
+	}
+
+	if s.options.XdpRedirectArp {
+		if s.arpMapFd, err = createArpMap(); err != nil {
+			return err
+		}
+	}
+
+	if s.progFd, err = loadXdpProgram(s.mapFd, s.arpMapFd, s.options.XdpPorts); err != nil {
+		return err
+	}
+
+	if err = s.attach(); err != nil {
+		return err
+	}
+
+	if s.options.PromiscuousMode {
+		if err = syscall.SetLsfPromisc(s.options.InterfaceName, true); err != nil {
+			return err
+		}
+		s.promisc = true
+	}
+
+	mode := "copy"
+	if s.zeroCopy {
+		mode = "zero-copy"
+	}
+
+	s.addLog("AF_XDP socket on " + s.options.InterfaceName + " in " + mode + " mode.")
+
+	return nil
+}
+
+func (s *XdpSocketeer) initUmem() error {
+	var err error
+
+	if s.umem, err = unix.Mmap(-1, 0, s.frameCount*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE); err != nil {
+		return err
+	}
+
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(len(s.umem)),
+		Size: xdpFrameSize,
+	}
+
+	if err = setsockopt(s.socketFd, unix.SOL_XDP, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return err
+	}
+
+	// The back half of the UMEM is for sending.
+	s.txFree = make([]uint64, 0, s.frameCount/2)
+	for i := s.frameCount / 2; i < s.frameCount; i++ {
+		s.txFree = append(s.txFree, uint64(i*xdpFrameSize))
+	}
+
+	return nil
+}
+
+func (s *XdpSocketeer) initRings() error {
+
+	ringSize := s.frameCount / 2
+
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING, unix.XDP_TX_RING} {
+		if err := unix.SetsockoptInt(s.socketFd, unix.SOL_XDP, opt, ringSize); err != nil {
+			return err
+		}
+	}
+
+	var offsets unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(offsets))
+
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(s.socketFd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&offsets)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return errno
+	}
+
+	var err error
+
+	if s.fill, err = s.mmapRing(unix.XDP_UMEM_PGOFF_FILL_RING, offsets.Fr, ringSize, 8); err != nil {
+		return err
+	}
+
+	if s.comp, err = s.mmapRing(unix.XDP_UMEM_PGOFF_COMPLETION_RING, offsets.Cr, ringSize, 8); err != nil {
+		return err
+	}
+
+	if s.rx, err = s.mmapRing(unix.XDP_PGOFF_RX_RING, offsets.Rx, ringSize, int(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return err
+	}
+
+	if s.tx, err = s.mmapRing(unix.XDP_PGOFF_TX_RING, offsets.Tx, ringSize, int(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return err
+	}
+
+	// Hand the whole front half of the UMEM to the kernel to receive into.
+	for i := 0; i < ringSize; i++ {
+		*s.fill.addr(uint32(i)) = uint64(i * xdpFrameSize)
+	}
+	atomic.StoreUint32(s.fill.producer, uint32(ringSize))
+
+	return nil
+}
+
+func (s *XdpSocketeer) mmapRing(pgoff int64, off unix.XDPRingOffset, count int, entrySize int) (*xdpRing, error) {
+
+	mem, err := unix.Mmap(s.socketFd, pgoff, int(off.Desc)+count*entrySize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		descs:    unsafe.Pointer(&mem[off.Desc]),
+		mask:     uint32(count - 1),
+	}, nil
+}
+
+func (s *XdpSocketeer) bind() error {
+
+	addr := unix.SockaddrXDP{
+		Ifindex: uint32(s.IfInfo.Index),
+		QueueID: uint32(s.options.XdpQueueID),
+	}
+
+	if !s.options.XdpCopyMode {
+		addr.Flags = unix.XDP_ZEROCOPY
+
+		if err := unix.Bind(s.socketFd, &addr); err == nil {
+			s.zeroCopy = true
+			return nil
+		}
+	}
+
+	addr.Flags = unix.XDP_COPY
+
+	return unix.Bind(s.socketFd, &addr)
+}
+
+// attach tries a native (driver) XDP hook first and falls back to the generic one.
+func (s *XdpSocketeer) attach() error {
+
+	var err error
+
+	for _, mode := range []int{unix.XDP_FLAGS_DRV_MODE, unix.XDP_FLAGS_SKB_MODE} {
+		flags := unix.XDP_FLAGS_UPDATE_IF_NOEXIST | mode
+
+		if err = netlink.LinkSetXdpFdWithFlags(s.link, s.progFd, flags); err == nil {
+			s.xdpFlags = flags
+			s.attached = true
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (s *XdpSocketeer) DeInit() error {
+
+	var err error
+
+	if s.attached {
+		err = netlink.LinkSetXdpFdWithFlags(s.link, -1, s.xdpFlags&unix.XDP_FLAGS_MODES)
+		s.attached = false
+	}
+
+	if s.promisc {
+		if promiscErr := syscall.SetLsfPromisc(s.options.InterfaceName, false); err == nil {
+			err = promiscErr
+		}
+		s.promisc = false
+	}
+
+	for _, fd := range []*int{&s.progFd, &s.mapFd, &s.arpMapFd, &s.socketFd} {
+		if *fd >= 0 {
+			if closeErr := unix.Close(*fd); err == nil {
+				err = closeErr
+			}
+			*fd = -1
+		}
+	}
+
+	for _, r := range []**xdpRing{&s.fill, &s.comp, &s.rx, &s.tx} {
+		if *r != nil {
+			if unmapErr := unix.Munmap((*r).mem); err == nil {
+				err = unmapErr
+			}
+			*r = nil
+		}
+	}
+
+	if s.umem != nil {
+		if unmapErr := unix.Munmap(s.umem); err == nil {
+			err = unmapErr
+		}
+		s.umem = nil
+	}
+
+	return err
+}
+
+func (s *XdpSocketeer) RunListener() {
+
+	pollFds := []unix.PollFd{{Fd: int32(s.socketFd), Events: unix.POLLIN}}
+
+	for {
+
+		select {
+		case _, _ = <-s.finishChannel:
+			close(s.doneChannel)
+			return
+		default:
+		}
+
+		if msgs := s.receive(); len(msgs) > 0 {
+			s.handleMessages(msgs)
+			continue
+		}
+
+		if _, err := unix.Poll(pollFds, rxRingPollTimeout); err != nil && err != unix.EINTR {
+			s.addError(err)
+		}
+	}
+}
+
+// receive copies everything waiting on the rx ring out of the UMEM and gives the frames straight back on the fill ring.
+func (s *XdpSocketeer) receive() []message.Message {
+
+	cons := atomic.LoadUint32(s.rx.consumer)
+	n := atomic.LoadUint32(s.rx.producer) - cons
+
+	if n == 0 {
+		return nil
+	}
+
+	msgs := make([]message.Message, 0, n)
+	fillProd := atomic.LoadUint32(s.fill.producer)
+
+	for i := uint32(0); i < n; i++ {
+		d := s.rx.desc(cons + i)
+
+		data := make([]byte, d.Len)
+		copy(data, s.umem[d.Addr:d.Addr+uint64(d.Len)])
+
+		msgs = append(msgs, message.Message{
+			Packet: gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true}),
+		})
+
+		*s.fill.addr(fillProd + i) = d.Addr &^ (xdpFrameSize - 1)
+	}
+
+	atomic.StoreUint32(s.rx.consumer, cons+n)
+	atomic.StoreUint32(s.fill.producer, fillProd+n)
+
+	return msgs
+}
+
+func (s *XdpSocketeer) RunWriter() {
+
+	batch := make([][]byte, 0, s.frameCount/2)
+
+	for payload := range s.outputChannel {
+
+		batch = append(batch[:0], payload)
+
+		// Pick up whatever else is already queued so it goes out with a single kick.
+	fill:
+		for len(batch) < cap(batch) {
+			select {
+			case payload, ok := <-s.outputChannel:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, payload)
+			default:
+				break fill
+			}
+		}
+
+		s.transmit(batch)
+	}
+}
+
+func (s *XdpSocketeer) transmit(batch [][]byte) {
+
+	prod := atomic.LoadUint32(s.tx.producer)
+
+	for _, payload := range batch {
+
+		if len(payload) > xdpFrameSize {
+			s.addError(errors.New("Frame too large for an XDP frame"))
+			packet.Release(payload)
+			continue
+		}
+
+		addr, ok := s.txFrame()
+		for !ok {
+			// Out of frames.  Publish what we have so far and wait on completions.
+			atomic.StoreUint32(s.tx.producer, prod)
+			s.kick()
+			runtime.Gosched()
+			addr, ok = s.txFrame()
+		}
+
+		copy(s.umem[addr:], payload)
+		s.onSent.sent(payload) // On the tx ring is as far as we can follow it.
+		packet.Release(payload)
+
+		d := s.tx.desc(prod)
+		d.Addr = addr
+		d.Len = uint32(len(payload))
+		d.Options = 0
+
+		prod++
+	}
+
+	atomic.StoreUint32(s.tx.producer, prod)
+	s.kick()
+}
+
+// txFrame hands out a free frame from the back half of the UMEM, collecting completed ones first if needed.
+func (s *XdpSocketeer) txFrame() (uint64, bool) {
+
+	if len(s.txFree) == 0 {
+		cons := atomic.LoadUint32(s.comp.consumer)
+		prod := atomic.LoadUint32(s.comp.producer)
+
+		for i := cons; i != prod; i++ {
+			s.txFree = append(s.txFree, *s.comp.addr(i))
+		}
+
+		atomic.StoreUint32(s.comp.consumer, prod)
+	}
+
+	if len(s.txFree) == 0 {
+		return 0, false
+	}
+
+	addr := s.txFree[len(s.txFree)-1]
+	s.txFree = s.txFree[:len(s.txFree)-1]
+
+	return addr, true
+}
+
+// kick tells the kernel there's something on the tx ring.
+func (s *XdpSocketeer) kick() {
+	_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(s.socketFd), 0, 0, unix.MSG_DONTWAIT, 0, 0)
+
+	if errno != 0 && errno != unix.EAGAIN && errno != unix.EBUSY && errno != unix.ENOBUFS {
+		s.addError(errno)
+	}
+}
+
+func (s *XdpSocketeer) StopListener() error {
+	s.finishChannel <- struct{}{}
+	_, _ = <-s.doneChannel
+	return nil
+}
+
+func (s *XdpSocketeer) StopWriter() error {
+	close(s.outputChannel)
+	return nil
+}
+
+func (s *XdpSocketeer) AddPayload(payload []byte) bool {
+	s.outputChannel <- payload
+	return true
+}
+
+func setsockopt(fd int, level int, opt int, value unsafe.Pointer, size uintptr) error {
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(value), size, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
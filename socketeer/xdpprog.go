@@ -0,0 +1,279 @@
+package socketeer
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"unsafe"
+)
+
+/*
+	The XDP program that steers replies into the AF_XDP socket.  It's small enough to write out by hand, which saves
+	pulling in a BPF compiler and loader for a couple dozen instructions.
+
+	Roughly:
+
+		if frame is an ARP request for an address in the ARP map	-> redirect
+		if frame is IPv4 without options, UDP, to one of the ports	-> redirect
+		anything else												-> XDP_PASS
+
+	The handler adds addresses to the ARP map as it acquires them, so the host still sees every other ARP frame and
+	its own neighbour resolution keeps working.  The redirect goes through an XSKMAP keyed by RX queue.  If there's no
+	socket on the queue the frame is passed up to the kernel instead.
+
+	Loads from the packet are in host order, so anything compared against them goes through htons.
+*/
+
+const (
+	bpfHelperMapLookupElem = 1
+	bpfHelperRedirectMap   = 51
+	bpfPseudoMapFd         = 1
+	bpfMapTypeHash         = 1
+	bpfFNoPrealloc         = 1
+	xdpPass                = 2
+
+	xdpArpMaxAddresses = 1 << 20 // Not preallocated, so this is only a ceiling.
+
+	// struct xdp_md
+	xdpMdData         = 0
+	xdpMdDataEnd      = 4
+	xdpMdRxQueueIndex = 16
+
+	// Offsets into an untagged frame.
+	ethertypeOffset   = 12
+	arpOpOffset       = 20
+	arpTargetIPOffset = 38
+	ipVersionOffset   = 14
+	ipProtocolOffset  = 23
+	udpDstPortOffset  = 36
+	headersLength     = 42 // Up to the end of the ARP target IP, which is past the UDP destination port as well.
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high one.
+	off  int16
+	imm  int32
+}
+
+func insn(code uint8, dst uint8, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+// htons gives what a 16-bit load of v in network order reads as on this host.
+func htons(v uint16) int32 {
+	b := [2]byte{byte(v >> 8), byte(v)}
+	return int32(*(*uint16)(unsafe.Pointer(&b[0])))
+}
+
+// bpfProgram collects instructions and fills in jump offsets, which are relative to the next instruction, from labels.
+type bpfProgram struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (p *bpfProgram) add(i bpfInsn) {
+	p.insns = append(p.insns, i)
+}
+
+func (p *bpfProgram) jump(i bpfInsn, label string) {
+	p.jumps[len(p.insns)] = label
+	p.insns = append(p.insns, i)
+}
+
+func (p *bpfProgram) label(name string) {
+	p.labels[name] = len(p.insns)
+}
+
+func (p *bpfProgram) resolve() []bpfInsn {
+	for i, label := range p.jumps {
+		p.insns[i].off = int16(p.labels[label] - i - 1)
+	}
+
+	return p.insns
+}
+
+// xdpRedirectProgram redirects UDP to any of ports, and ARP requests for addresses in the ARP map if arpMapFd >= 0.
+func xdpRedirectProgram(mapFd int, arpMapFd int, ports []int) []bpfInsn {
+
+	p := &bpfProgram{labels: make(map[string]int), jumps: make(map[int]string)}
+
+	p.add(insn(0xbf, 6, 1, 0, 0))               // r6 = r1 (ctx)
+	p.add(insn(0x61, 2, 6, xdpMdData, 0))       // r2 = ctx->data
+	p.add(insn(0x61, 3, 6, xdpMdDataEnd, 0))    // r3 = ctx->data_end
+	p.add(insn(0xbf, 4, 2, 0, 0))               // r4 = r2
+	p.add(insn(0x07, 4, 0, 0, headersLength))   // r4 += headersLength
+	p.jump(insn(0x2d, 4, 3, 0, 0), "pass")      // if r4 > r3 goto pass
+	p.add(insn(0x69, 5, 2, ethertypeOffset, 0)) // r5 = ethertype
+	if arpMapFd >= 0 {
+		p.jump(insn(0x15, 5, 0, 0, htons(0x0806)), "arp") // if ARP goto arp
+	}
+	p.jump(insn(0x55, 5, 0, 0, htons(0x0800)), "pass") // if not IPv4 goto pass
+	p.add(insn(0x71, 5, 2, ipVersionOffset, 0))        // r5 = version/IHL
+	p.jump(insn(0x55, 5, 0, 0, 0x45), "pass")          // if IP options goto pass
+	p.add(insn(0x71, 5, 2, ipProtocolOffset, 0))       // r5 = IP protocol
+	p.jump(insn(0x55, 5, 0, 0, 17), "pass")            // if not UDP goto pass
+	p.add(insn(0x69, 5, 2, udpDstPortOffset, 0))       // r5 = UDP destination port
+	for _, port := range ports {
+		p.jump(insn(0x15, 5, 0, 0, htons(uint16(port))), "redirect") // if port goto redirect
+	}
+	p.jump(insn(0x05, 0, 0, 0, 0), "pass") // goto pass
+
+	if arpMapFd >= 0 {
+		p.label("arp")
+		p.add(insn(0x69, 5, 2, arpOpOffset, 0))                  // r5 = ARP operation
+		p.jump(insn(0x55, 5, 0, 0, htons(1)), "pass")            // if not a request goto pass
+		p.add(insn(0x61, 5, 2, arpTargetIPOffset, 0))            // r5 = target IP
+		p.add(insn(0x63, 10, 5, -4, 0))                          // *(u32 *)(r10 - 4) = r5, as the key
+		p.add(insn(0x18, 1, bpfPseudoMapFd, 0, int32(arpMapFd))) // r1 = ARP map
+		p.add(insn(0x00, 0, 0, 0, 0))                            // (second half of the 64-bit load)
+		p.add(insn(0xbf, 2, 10, 0, 0))                           // r2 = r10
+		p.add(insn(0x07, 2, 0, 0, -4))                           // r2 -= 4
+		p.add(insn(0x85, 0, 0, 0, bpfHelperMapLookupElem))       // call bpf_map_lookup_elem
+		p.jump(insn(0x55, 0, 0, 0, 0), "redirect")               // if found goto redirect
+	}
+
+	p.label("pass")
+	p.add(insn(0xb7, 0, 0, 0, xdpPass)) // r0 = XDP_PASS
+	p.add(insn(0x95, 0, 0, 0, 0))       // exit
+
+	p.label("redirect")
+	p.add(insn(0x61, 2, 6, xdpMdRxQueueIndex, 0))         // r2 = ctx->rx_queue_index
+	p.add(insn(0x18, 1, bpfPseudoMapFd, 0, int32(mapFd))) // r1 = map
+	p.add(insn(0x00, 0, 0, 0, 0))                         // (second half of the 64-bit load)
+	p.add(insn(0xb7, 3, 0, 0, xdpPass))                   // r3 = XDP_PASS, the action if the redirect fails
+	p.add(insn(0x85, 0, 0, 0, bpfHelperRedirectMap))      // call bpf_redirect_map
+	p.add(insn(0x95, 0, 0, 0, 0))                         // exit
+
+	return p.resolve()
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapUpdateAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [16]byte
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func createXskMap(entries int) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    unix.BPF_MAP_TYPE_XSKMAP,
+		keySize:    4,
+		valueSize:  4,
+		maxEntries: uint32(entries),
+	}
+
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// createArpMap makes the set of IPv4 addresses, in network order, whose ARP requests get redirected.
+func createArpMap() (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    bpfMapTypeHash,
+		keySize:    4,
+		valueSize:  1,
+		maxEntries: xdpArpMaxAddresses,
+		mapFlags:   bpfFNoPrealloc,
+	}
+
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func updateMap(mapFd int, key unsafe.Pointer, value unsafe.Pointer) error {
+	attr := bpfMapUpdateAttr{
+		mapFd: uint32(mapFd),
+		key:   uint64(uintptr(key)),
+		value: uint64(uintptr(value)),
+	}
+
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	return err
+}
+
+func updateXskMap(mapFd int, queueID int, socketFd int) error {
+	key := uint32(queueID)
+	value := uint32(socketFd)
+
+	err := updateMap(mapFd, unsafe.Pointer(&key), unsafe.Pointer(&value))
+
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+
+	return err
+}
+
+func addArpAddress(mapFd int, ip [4]byte) error {
+	value := byte(1)
+
+	err := updateMap(mapFd, unsafe.Pointer(&ip[0]), unsafe.Pointer(&value))
+
+	runtime.KeepAlive(&ip)
+	runtime.KeepAlive(&value)
+
+	return err
+}
+
+func loadXdpProgram(mapFd int, arpMapFd int, ports []int) (int, error) {
+	prog := xdpRedirectProgram(mapFd, arpMapFd, ports)
+	license := []byte("GPL\x00")
+	log := make([]byte, 65536)
+
+	attr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_XDP,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	copy(attr.progName[:], "dhammer_xsk")
+
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+
+	if err != nil {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return -1, errors.New("XDP program rejected: " + err.Error() + ": " + string(log[:n]))
+		}
+		return -1, err
+	}
+
+	return fd, nil
+}
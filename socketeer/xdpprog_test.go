@@ -0,0 +1,52 @@
+package socketeer
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestXdpRedirectProgram(t *testing.T) {
+
+	// What a 16-bit load of the ARP ethertype off the wire gives on this host.
+	wire := []byte{0x08, 0x06}
+	if loaded := *(*uint16)(unsafe.Pointer(&wire[0])); int32(loaded) != htons(0x0806) {
+		t.Errorf("htons(0x0806) is %#x, a load gives %#x", htons(0x0806), loaded)
+	}
+
+	prog := xdpRedirectProgram(3, 4, []int{67, 1067})
+
+	redirect := -1
+	for i, in := range prog {
+		if in.code == 0x61 && in.off == xdpMdRxQueueIndex {
+			redirect = i
+		}
+	}
+
+	ports := 0
+	for i, in := range prog {
+		if in.code == 0x15 && (in.imm == htons(67) || in.imm == htons(1067)) {
+			ports++
+
+			if target := i + 1 + int(in.off); target != redirect {
+				t.Errorf("Port check at %d jumps to %d, not the redirect at %d", i, target, redirect)
+			}
+		}
+
+		if in.code&0x07 == 0x05 && in.code != 0x85 && in.code != 0x95 {
+			if target := i + 1 + int(in.off); target <= i || target >= len(prog) {
+				t.Errorf("Jump at %d goes to %d", i, target)
+			}
+		}
+	}
+
+	if ports != 2 {
+		t.Errorf("Expected 2 port checks, found %d", ports)
+	}
+
+	// Without an ARP map there's no ARP section, and no lookup.
+	for _, in := range xdpRedirectProgram(3, -1, []int{68}) {
+		if in.code == 0x85 && in.imm == bpfHelperMapLookupElem {
+			t.Error("ARP lookup without an ARP map")
+		}
+	}
+}
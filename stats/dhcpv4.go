@@ -2,38 +2,35 @@ package stats
 
 import (
 	"encoding/json"
-	//"fmt"
 	"github.com/ipchama/dhammer/config"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-const (
-	DiscoverSentStat = iota
-	InfoSentStat
-	RequestSentStat
-	DeclineSentStat
-	ReleaseSentStat
-
-	OfferReceivedStat
-	AckReceivedStat
-	NakReceivedStat
-
-	ArpReplySentStat
-	ArpRequestReceivedStat
-)
-
 type StatsV4 struct {
 	options *config.DhcpV4Options
 
-	countersMux *sync.RWMutex
-	counters    [10]Stat
+	registry   *Registry
+	exhaustion *exhaustionDetector
+	exporter   *Exporter
+	history    *history
+
+	tickMux  sync.Mutex
+	lastTick time.Time
+
+	discoverSent     *Counter
+	offerReceived    *Counter
+	addressesOffered *Gauge
+	poolExhausted    *Gauge
+	timeToExhaustion *Gauge
 
 	addLog   func(string) bool
 	addError func(error) bool
 
-	statChannel chan StatValue
-	doneChannel chan struct{}
+	finishChannel chan struct{}
+	doneChannel   chan struct{}
 }
 
 func init() {
@@ -44,104 +41,130 @@ func init() {
 
 func NewStatsDhcpV4(sip StatsInitParams) Stats {
 	s := StatsV4{
-		options:     sip.options.(*config.DhcpV4Options),
-		addLog:      sip.logFunc,
-		addError:    sip.errFunc,
-		statChannel: make(chan StatValue, 10000),
-		doneChannel: make(chan struct{}, 1),
-		countersMux: &sync.RWMutex{},
+		options:       sip.options.(*config.DhcpV4Options),
+		registry:      NewRegistry(),
+		exhaustion:    newExhaustionDetector(),
+		history:       newHistory(sip.options.(*config.DhcpV4Options).StatsHistorySize),
+		addLog:        sip.logFunc,
+		addError:      sip.errFunc,
+		finishChannel: make(chan struct{}, 1),
+		doneChannel:   make(chan struct{}, 1),
 	}
 
 	return &s
 }
 
-func (s *StatsV4) AddStat(sv StatValue) bool {
-	select {
-	case s.statChannel <- sv:
-		return true
-	default:
-	}
-	return false
+func (s *StatsV4) Registry() *Registry {
+	return s.registry
 }
 
 func (s *StatsV4) Init() error {
 
-	s.counters[0].Name = "DiscoverSent"
-	s.counters[1].Name = "InfoSent"
-	s.counters[2].Name = "RequestSent"
-	s.counters[3].Name = "DeclineSent"
-	s.counters[4].Name = "ReleaseSent"
-	s.counters[5].Name = "OfferReceived"
-	s.counters[6].Name = "AckReceived"
-	s.counters[7].Name = "NakReceived"
+	var err error
 
-	s.counters[8].Name = "ArpReplySent"
-	s.counters[9].Name = "ArpRequestReceived"
+	if s.options.StatsExportAddress != "" {
+		if s.exporter, err = NewExporter(s.options.StatsExportFormat, s.options.StatsExportProtocol, s.options.StatsExportAddress, s.options.StatsExportPrefix, s.options.StatsExportTags); err == nil {
+			s.exporter.Start(s.addError)
+		}
+	}
 
-	return nil
+	return err
 }
 
 func (s *StatsV4) DeInit() error {
+
+	if s.exporter != nil {
+		return s.exporter.Close()
+	}
+
 	return nil
 }
 
 func (s *StatsV4) Run() {
 
-	var wg sync.WaitGroup
+	// These are declared by the generator and handler during their Init.  Fetching them here keeps the declaration order theirs.
+	s.discoverSent = s.registry.Counter("DiscoverSent")
+	s.offerReceived = s.registry.Counter("OfferReceived")
+	s.addressesOffered = s.registry.Gauge("AddressesOffered")
+	s.poolExhausted = s.registry.Gauge("PoolExhausted")
+	s.timeToExhaustion = s.registry.Gauge("TimeToExhaustionSeconds")
+
+	s.tickMux.Lock()
+	s.lastTick = time.Now()
+	s.tickMux.Unlock()
+
+	ticker := time.NewTicker(s.options.StatsInterval)
+
+	for {
+		select {
+		case <-s.finishChannel:
+			ticker.Stop()
+			close(s.doneChannel)
+			return
+		case <-ticker.C:
+		}
 
-	wg.Add(1)
+		if err := s.calculateStats(); err != nil {
+			s.addError(err)
+		}
+	}
+}
 
-	stopTicker := make(chan struct{})
+func (s *StatsV4) calculateStats() error {
 
-	ticker := time.NewTicker(time.Duration(s.options.StatsRate) * time.Second)
-	go func() {
-		for {
-			select {
-			case <-stopTicker:
-				ticker.Stop()
-				wg.Done()
-				return
-			case <-ticker.C:
-			}
+	s.tickMux.Lock()
+	defer s.tickMux.Unlock()
 
-			if err := s.calculateStats(); err != nil {
-				s.addError(err)
-			}
-		}
-	}()
+	// Tickers can drift and drop ticks, so rates use the real time since the last tick rather than the configured interval.
+	now := time.Now()
+	s.registry.Tick(now.Sub(s.lastTick).Seconds())
+	s.lastTick = now
 
-	for sv := range s.statChannel {
-		s.countersMux.Lock()
-		s.counters[sv].Value++
-		s.countersMux.Unlock()
+	if msg := s.exhaustion.tick(s.discoverSent.Value(), s.offerReceived.Value(), int(s.addressesOffered.Value()), now); msg != "" {
+		s.addLog(msg)
 	}
 
-	stopTicker <- struct{}{}
-	wg.Wait()
+	if s.exhaustion.exhausted {
+		s.poolExhausted.Set(1)
+		s.timeToExhaustion.Set(s.exhaustion.timeToExhaustion().Seconds())
+	} else {
+		s.poolExhausted.Set(0)
+	}
 
-	close(s.doneChannel)
-}
+	if jsonData, err := json.Marshal(s.registry); err != nil {
+		s.addError(err)
+	} else {
+		s.history.add(HistoryEntry{Timestamp: now, Stats: jsonData})
+	}
 
-func (s *StatsV4) calculateStats() error {
+	if s.options.StatsLog || s.exporter != nil {
+		samples := s.registry.Samples()
 
-	var StatsTickerRate float64 = float64(s.options.StatsRate)
+		if s.options.StatsLog {
+			s.addLog(formatSamples(samples))
+		}
 
-	s.countersMux.Lock()
-	for i := 0; i < len(s.counters); i++ {
-		s.counters[i].RatePerSecond = float64((s.counters[i].Value - s.counters[i].PreviousTickerValue)) / StatsTickerRate
-		s.counters[i].PreviousTickerValue = s.counters[i].Value
+		if s.exporter != nil {
+			s.exporter.Push(samples, now)
+		}
 	}
-	s.countersMux.Unlock()
 
 	return nil
 }
 
 func (s *StatsV4) String() string {
 
-	s.countersMux.RLock()
-	defer s.countersMux.RUnlock()
+	if jsonData, err := json.MarshalIndent(s.registry, "", "  "); err != nil {
+		s.addError(err)
+		return ""
+	} else {
+		return string(jsonData)
+	}
+}
 
-	if jsonData, err := json.MarshalIndent(s.counters, "", "  "); err != nil {
+func (s *StatsV4) History(since time.Time) string {
+
+	if jsonData, err := json.MarshalIndent(s.history.since(since), "", "  "); err != nil {
 		s.addError(err)
 		return ""
 	} else {
@@ -149,9 +172,60 @@ func (s *StatsV4) String() string {
 	}
 }
 
+// Reset zeroes counters between test phases.  The next rates are calculated from the time of the reset.
+func (s *StatsV4) Reset() error {
+
+	s.tickMux.Lock()
+	defer s.tickMux.Unlock()
+
+	s.registry.Reset()
+	s.exhaustion = newExhaustionDetector()
+	s.lastTick = time.Now()
+
+	if s.poolExhausted != nil {
+		s.poolExhausted.Set(0)
+		s.timeToExhaustion.Set(0)
+	}
+
+	s.addLog("Stats reset.")
+
+	return nil
+}
+
 func (s *StatsV4) Stop() error {
-	close(s.statChannel)
+	s.finishChannel <- struct{}{}
 	_, _ = <-s.doneChannel
 
 	return nil
 }
+
+// formatSamples renders samples as a single log line, e.g. OfferReceived=10(2.5/s) OfferReceived{server_id=10.0.0.1}=10(2.5/s)
+func formatSamples(samples []Sample) string {
+	var b strings.Builder
+
+	b.WriteString("STATS:")
+
+	for _, sample := range samples {
+		b.WriteString(" ")
+		b.WriteString(sample.Name)
+
+		if sample.Type == InfoType { // e.g. ProfilePhase=warmup
+			for _, v := range sample.Labels {
+				b.WriteString("=" + v)
+			}
+			continue
+		}
+
+		for k, v := range sample.Labels {
+			b.WriteString("{" + k + "=" + v + "}")
+		}
+
+		b.WriteString("=" + strconv.FormatFloat(sample.Value, 'f', -1, 64))
+
+		if sample.Type == CounterType {
+			b.WriteString("(" + strconv.FormatFloat(sample.RatePerSecond, 'f', 2, 64) + "/s)")
+		}
+	}
+
+	return b.String()
+}
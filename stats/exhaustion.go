@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+	A pool looks exhausted when DISCOVERs keep going out for exhaustionQuietTime but not a single OFFER comes back,
+	after the server had been offering before.  If the server never offered anything, it's just not answering, which is a different problem.
+	A single tick without OFFERs means nothing with short ticks, where replies can simply land in the next one.
+	Times are only as accurate as the stats tick.  Besides the log line, the PoolExhausted and TimeToExhaustionSeconds
+	gauges carry the result, so it makes it into exports and the history.
+*/
+
+const exhaustionQuietTime = 3 * time.Second
+
+type exhaustionDetector struct {
+	firstDiscover time.Time
+	lastOffer     time.Time
+	previousTick  time.Time
+
+	previousDiscovers int
+	previousOffers    int
+	unanswered        int // DISCOVERs since the last tick with an OFFER.
+
+	exhausted bool
+}
+
+// timeToExhaustion is how long the pool lasted, from the first DISCOVER to the last OFFER.
+func (e *exhaustionDetector) timeToExhaustion() time.Duration {
+	return e.lastOffer.Sub(e.firstDiscover)
+}
+
+func newExhaustionDetector() *exhaustionDetector {
+	return &exhaustionDetector{
+		previousTick: time.Now(),
+	}
+}
+
+// tick takes the current DiscoverSent and OfferReceived totals and returns a message whenever the pool state changes.
+func (e *exhaustionDetector) tick(discoverTotal int, offerTotal int, uniqueOffered int, now time.Time) string {
+
+	discovers := discoverTotal - e.previousDiscovers
+	offers := offerTotal - e.previousOffers
+
+	e.previousDiscovers = discoverTotal
+	e.previousOffers = offerTotal
+
+	if discovers > 0 && e.firstDiscover.IsZero() {
+		e.firstDiscover = e.previousTick
+	}
+
+	e.previousTick = now
+
+	if offers > 0 {
+		e.lastOffer = now
+		e.unanswered = 0
+
+		if e.exhausted {
+			e.exhausted = false
+			return fmt.Sprintf("Pool exhaustion cleared: OFFERs resumed. %d unique addresses offered so far.", uniqueOffered)
+		}
+		return ""
+	}
+
+	e.unanswered += discovers
+
+	if e.exhausted || e.unanswered == 0 || e.lastOffer.IsZero() || now.Sub(e.lastOffer) < exhaustionQuietTime {
+		return ""
+	}
+
+	e.exhausted = true
+
+	return fmt.Sprintf("Pool exhaustion detected: no OFFERs for %d DISCOVERs since %s. Time to exhaustion: %s. Unique addresses offered before exhaustion: %d.",
+		e.unanswered, e.lastOffer.UTC().Format(time.RFC3339), e.timeToExhaustion(), uniqueOffered)
+}
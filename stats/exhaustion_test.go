@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExhaustionDetector(t *testing.T) {
+
+	start := time.Now()
+	e := &exhaustionDetector{previousTick: start}
+
+	if msg := e.tick(10, 0, 0, start); msg != "" {
+		t.Errorf("Detector flagged exhaustion before any offer was seen: %s", msg)
+	}
+
+	if msg := e.tick(20, 3, 2, start.Add(5*time.Second)); msg != "" {
+		t.Errorf("Detector flagged exhaustion while offers were flowing: %s", msg)
+	}
+
+	if msg := e.tick(30, 3, 2, start.Add(10*time.Second)); msg == "" || !e.exhausted {
+		t.Errorf("Detector did not flag exhaustion.")
+	}
+
+	if d := e.timeToExhaustion(); d != 5*time.Second {
+		t.Errorf("Expected 5s to exhaustion, got %s.", d)
+	}
+
+	if msg := e.tick(40, 3, 2, start.Add(15*time.Second)); msg != "" {
+		t.Errorf("Detector reported exhaustion twice: %s", msg)
+	}
+
+	if msg := e.tick(50, 4, 3, start.Add(20*time.Second)); msg == "" || e.exhausted {
+		t.Errorf("Detector did not clear exhaustion once offers resumed.")
+	}
+}
+
+func TestExhaustionDetectorShortTicks(t *testing.T) {
+
+	start := time.Now()
+	e := &exhaustionDetector{previousTick: start}
+
+	discovers, offers := 0, 0
+	now := start
+
+	// 50ms ticks with OFFERs only landing every fourth tick, as with a server that takes 150ms to answer.
+	for i := 1; i <= 200; i++ {
+		now = start.Add(time.Duration(i) * 50 * time.Millisecond)
+		discovers += 10
+
+		if i%4 == 0 {
+			offers += 40
+		}
+
+		if msg := e.tick(discovers, offers, offers, now); msg != "" {
+			t.Fatalf("Detector flapped on tick %d: %s", i, msg)
+		}
+	}
+
+	quietSince := now
+
+	for i := 1; !e.exhausted; i++ {
+		now = quietSince.Add(time.Duration(i) * 50 * time.Millisecond)
+		discovers += 10
+
+		msg := e.tick(discovers, offers, offers, now)
+
+		if e.exhausted && msg == "" {
+			t.Errorf("Detector flagged exhaustion without saying so.")
+		}
+
+		if now.Sub(quietSince) > 2*exhaustionQuietTime {
+			t.Fatalf("Detector didn't flag exhaustion after %s without OFFERs.", now.Sub(quietSince))
+		}
+	}
+
+	if quiet := now.Sub(quietSince); quiet < exhaustionQuietTime {
+		t.Errorf("Detector flagged exhaustion after only %s without OFFERs.", quiet)
+	}
+}
@@ -0,0 +1,324 @@
+package stats
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	The exporter pushes every sample to a StatsD or InfluxDB line-protocol endpoint at each stats tick.
+	Counters go out as their current value plus their rate, so nothing is lost if a packet is dropped.
+	Labels are sent as tags alongside the configured ones.
+
+	Pushing happens on a goroutine of its own, so a slow or dead endpoint never holds up a stats tick.  Ticks that
+	come in while it's busy are dropped, as are ticks while it's backing off from a failed send, which loses nothing
+	since every push carries the running totals.
+
+	Neither format takes NaN or infinity, which a mean gauge or rate can come up with, so those values are left out.
+*/
+
+const (
+	StatsdFormat = "statsd"
+	InfluxFormat = "influx"
+
+	maxDatagramSize = 1400 // Keep UDP payloads under a typical MTU.
+
+	exportQueueSize  = 4
+	exportMinBackoff = time.Second
+	exportMaxBackoff = 30 * time.Second
+)
+
+type exportBatch struct {
+	samples []Sample
+	now     time.Time
+}
+
+type Exporter struct {
+	format  string
+	network string
+	address string
+	prefix  string
+	tags    map[string]string
+
+	conn net.Conn
+
+	queue    chan exportBatch
+	done     chan struct{}
+	addError func(error) bool
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+// NewExporter returns an exporter for format (statsd or influx) that sends to address over network (udp or tcp).
+func NewExporter(format string, network string, address string, prefix string, tags map[string]string) (*Exporter, error) {
+
+	if format != StatsdFormat && format != InfluxFormat {
+		return nil, errors.New("Unknown stats export format: " + format)
+	}
+
+	if network != "udp" && network != "tcp" {
+		return nil, errors.New("Unknown stats export protocol: " + network)
+	}
+
+	return &Exporter{
+		format:  format,
+		network: network,
+		address: address,
+		prefix:  prefix,
+		tags:    tags,
+	}, nil
+}
+
+// Start pushes whatever is handed to Push from here on, until Close.
+func (e *Exporter) Start(errFunc func(error) bool) {
+
+	e.queue = make(chan exportBatch, exportQueueSize)
+	e.done = make(chan struct{})
+	e.addError = errFunc
+
+	go e.run()
+}
+
+// Push hands samples to the exporter's goroutine, or drops them if it's behind.
+func (e *Exporter) Push(samples []Sample, now time.Time) {
+	select {
+	case e.queue <- exportBatch{samples: samples, now: now}:
+	default:
+	}
+}
+
+func (e *Exporter) run() {
+
+	defer close(e.done)
+
+	for batch := range e.queue {
+		if batch.now.Before(e.retryAt) {
+			continue
+		}
+
+		if err := e.Export(batch.samples, batch.now); err != nil {
+			e.addError(err)
+
+			if e.backoff *= 2; e.backoff < exportMinBackoff {
+				e.backoff = exportMinBackoff
+			} else if e.backoff > exportMaxBackoff {
+				e.backoff = exportMaxBackoff
+			}
+
+			e.retryAt = time.Now().Add(e.backoff)
+
+			continue
+		}
+
+		e.backoff = 0
+	}
+}
+
+func (e *Exporter) Export(samples []Sample, now time.Time) error {
+
+	if e.conn == nil {
+		conn, err := net.DialTimeout(e.network, e.address, 2*time.Second)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+
+	lines := make([]string, 0, len(samples)*2)
+
+	for _, sample := range samples {
+		if e.format == StatsdFormat {
+			lines = append(lines, e.statsdLines(sample)...)
+		} else if line := e.influxLine(sample, now); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	for _, payload := range e.pack(lines) {
+		if _, err := e.conn.Write(payload); err != nil {
+			// Reconnect next tick.  Mainly for TCP, but it doesn't hurt UDP.
+			e.conn.Close()
+			e.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) Close() error {
+
+	if e.queue != nil {
+		close(e.queue)
+		<-e.done
+		e.queue = nil
+	}
+
+	if e.conn == nil {
+		return nil
+	}
+
+	err := e.conn.Close()
+	e.conn = nil
+
+	return err
+}
+
+// pack groups lines into datagrams for UDP or a single stream write for TCP.
+func (e *Exporter) pack(lines []string) [][]byte {
+
+	if e.network == "tcp" {
+		return [][]byte{[]byte(strings.Join(lines, "\n") + "\n")}
+	}
+
+	payloads := make([][]byte, 0)
+	var payload []byte
+
+	for _, line := range lines {
+		if len(payload) > 0 && len(payload)+len(line)+1 > maxDatagramSize {
+			payloads = append(payloads, payload)
+			payload = nil
+		}
+
+		if len(payload) > 0 {
+			payload = append(payload, '\n')
+		}
+		payload = append(payload, line...)
+	}
+
+	if len(payload) > 0 {
+		payloads = append(payloads, payload)
+	}
+
+	return payloads
+}
+
+func (e *Exporter) name(sample Sample) string {
+	if e.prefix == "" {
+		return sample.Name
+	}
+	return e.prefix + "." + sample.Name
+}
+
+// Tags are configured tags plus the sample's labels, sorted so lines are stable.
+func (e *Exporter) sortedTags(sample Sample) [][2]string {
+	tags := make([][2]string, 0, len(e.tags)+len(sample.Labels))
+
+	for k, v := range e.tags {
+		tags = append(tags, [2]string{k, v})
+	}
+
+	for k, v := range sample.Labels {
+		tags = append(tags, [2]string{k, v})
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+
+	return tags
+}
+
+/*
+StatsD, with DogStatsD-style tags:
+
+	dhammer.OfferReceived:10|g|#server_id:10.0.0.1
+	dhammer.OfferReceived.rate:2.5|g|#server_id:10.0.0.1
+	dhammer.OfferReceived.rate_ewma_1s:2.4|g|#server_id:10.0.0.1
+	...
+*/
+func (e *Exporter) statsdLines(sample Sample) []string {
+	name := statsdEscaper.Replace(e.name(sample))
+
+	tagSuffix := ""
+	if tags := e.sortedTags(sample); len(tags) > 0 {
+		parts := make([]string, len(tags))
+		for i, t := range tags {
+			parts[i] = statsdEscaper.Replace(t[0]) + ":" + statsdEscaper.Replace(t[1])
+		}
+		tagSuffix = "|#" + strings.Join(parts, ",")
+	}
+
+	var lines []string
+
+	gauge := func(name string, v float64) {
+		if isFinite(v) {
+			lines = append(lines, name+":"+formatFloat(v)+"|g"+tagSuffix)
+		}
+	}
+
+	gauge(name, sample.Value)
+
+	if sample.Type == CounterType {
+		gauge(name+".rate", sample.RatePerSecond)
+
+		for i, w := range SmoothingWindows {
+			gauge(name+".rate_ewma_"+smoothingWindowName(w), sample.SmoothedRates[i])
+		}
+	}
+
+	return lines
+}
+
+/*
+InfluxDB line protocol:
+
+	dhammer.OfferReceived,server_id=10.0.0.1 value=10,rate_per_second=2.5,rate_ewma_1s=2.4,... 1600000000000000000
+
+A sample without a single finite field gives no line at all.
+*/
+func (e *Exporter) influxLine(sample Sample, now time.Time) string {
+	var b strings.Builder
+
+	b.WriteString(influxMeasurementEscaper.Replace(e.name(sample)))
+
+	for _, t := range e.sortedTags(sample) {
+		if t[1] == "" { // Line protocol doesn't take empty tag values, e.g. from an Info that hasn't been set yet.
+			continue
+		}
+
+		b.WriteString("," + influxTagEscaper.Replace(t[0]) + "=" + influxTagEscaper.Replace(t[1]))
+	}
+
+	separator := " "
+
+	field := func(key string, v float64) {
+		if isFinite(v) {
+			b.WriteString(separator + key + "=" + formatFloat(v))
+			separator = ","
+		}
+	}
+
+	field("value", sample.Value)
+
+	if sample.Type == CounterType {
+		field("rate_per_second", sample.RatePerSecond)
+
+		for i, w := range SmoothingWindows {
+			field("rate_ewma_"+smoothingWindowName(w), sample.SmoothedRates[i])
+		}
+	}
+
+	if separator == " " {
+		return ""
+	}
+
+	b.WriteString(" " + strconv.FormatInt(now.UnixNano(), 10))
+
+	return b.String()
+}
+
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+var influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+var influxTagEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,240 @@
+package stats_test
+
+import (
+	"bufio"
+	"github.com/ipchama/dhammer/stats"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSamples() []stats.Sample {
+	r := stats.NewRegistry()
+
+	offers := r.Counter("OfferReceived")
+	offers.Inc()
+	offers.Inc()
+	offers.IncBy("server_id", "10.0.0.1")
+	r.Gauge("AddressesOffered").Set(2)
+
+	r.Tick(2)
+
+	return r.Samples()
+}
+
+func TestExporterStatsdUDP(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e, err := stats.NewExporter(stats.StatsdFormat, "udp", conn.LocalAddr().String(), "dhammer", map[string]string{"lab": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if err = e.Export(testSamples(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(string(buf[:n]), "\n")
+	want := []string{
+		"dhammer.OfferReceived:2|g|#lab:a",
+		"dhammer.OfferReceived.rate:1|g|#lab:a",
+		"dhammer.OfferReceived.rate_ewma_1s:1|g|#lab:a",
+		"dhammer.OfferReceived.rate_ewma_10s:1|g|#lab:a",
+		"dhammer.OfferReceived.rate_ewma_60s:1|g|#lab:a",
+		"dhammer.OfferReceived:1|g|#lab:a,server_id:10.0.0.1",
+		"dhammer.OfferReceived.rate:0.5|g|#lab:a,server_id:10.0.0.1",
+		"dhammer.OfferReceived.rate_ewma_1s:0.5|g|#lab:a,server_id:10.0.0.1",
+		"dhammer.OfferReceived.rate_ewma_10s:0.5|g|#lab:a,server_id:10.0.0.1",
+		"dhammer.OfferReceived.rate_ewma_60s:0.5|g|#lab:a,server_id:10.0.0.1",
+		"dhammer.AddressesOffered:2|g|#lab:a",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected statsd payload:\n%s\nwanted:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExporterInfluxTCP(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 10)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	e, err := stats.NewExporter(stats.InfluxFormat, "tcp", l.Addr().String(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if err = e.Export(testSamples(), time.Unix(0, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"OfferReceived value=2,rate_per_second=1,rate_ewma_1s=1,rate_ewma_10s=1,rate_ewma_60s=1 42",
+		"OfferReceived,server_id=10.0.0.1 value=1,rate_per_second=0.5,rate_ewma_1s=0.5,rate_ewma_10s=0.5,rate_ewma_60s=0.5 42",
+		"AddressesOffered value=2 42",
+	}
+
+	for _, w := range want {
+		select {
+		case got := <-lines:
+			if got != w {
+				t.Errorf("Unexpected influx line %q, wanted %q", got, w)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %q", w)
+		}
+	}
+}
+
+func TestExporterRejectsUnknownFormat(t *testing.T) {
+	if _, err := stats.NewExporter("prometheus", "udp", "127.0.0.1:8125", "", nil); err == nil {
+		t.Errorf("Exporter accepted an unknown format.")
+	}
+}
+
+func TestExporterPushBacksOff(t *testing.T) {
+
+	// Nothing listens on a port we just closed, so every dial is refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	e, err := stats.NewExporter(stats.InfluxFormat, "tcp", address, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 10)
+	e.Start(func(err error) bool { errs <- err; return true })
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		e.Push(testSamples(), time.Now())
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Pushing to a dead endpoint took %v", elapsed)
+	}
+
+	e.Close()
+
+	if len(errs) != 1 {
+		t.Errorf("Expected one failed dial before backing off, got %d", len(errs))
+	}
+}
+
+func TestExporterInfluxSkipsEmptyTags(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e, err := stats.NewExporter(stats.InfluxFormat, "udp", conn.LocalAddr().String(), "", map[string]string{"lab": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	r := stats.NewRegistry()
+	r.Info("ProfilePhase", "phase")
+
+	if err = e.Export(r.Samples(), time.Unix(0, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[:n]); got != "ProfilePhase value=1 42" {
+		t.Errorf("Unexpected influx line %q", got)
+	}
+}
+
+func TestExporterSkipsNonFiniteValues(t *testing.T) {
+
+	r := stats.NewRegistry()
+	r.Gauge("PacingError").Set(math.NaN())
+	r.Gauge("AddressesOffered").Set(math.Inf(1))
+	r.Gauge("ClientsBound").Set(3)
+
+	for _, format := range []string{stats.StatsdFormat, stats.InfluxFormat} {
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := stats.NewExporter(format, "udp", conn.LocalAddr().String(), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = e.Export(r.Samples(), time.Unix(0, 42)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "ClientsBound:3|g"
+		if format == stats.InfluxFormat {
+			want = "ClientsBound value=3 42"
+		}
+
+		if got := string(buf[:n]); got != want {
+			t.Errorf("Unexpected %s payload %q, wanted %q", format, got, want)
+		}
+
+		e.Close()
+		conn.Close()
+	}
+}
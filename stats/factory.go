@@ -1,24 +1,125 @@
 package stats
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/ipchama/dhammer/config"
+	"sort"
+	"time"
 )
 
 type Stat struct {
-	Name                string  `json:"stat_name"`
-	Value               int     `json:"stat_value"`
-	PreviousTickerValue int     `json:"stat_previous_ticker_value"`
-	RatePerSecond       float64 `json:"stat_rate_per_second"`
+	Name                string                             `json:"stat_name"`
+	Value               int                                `json:"stat_value"`
+	PreviousTickerValue int                                `json:"stat_previous_ticker_value"`
+	RatePerSecond       float64                            `json:"stat_rate_per_second"`
+	RateEWMA1s          float64                            `json:"stat_rate_ewma_1s"`
+	RateEWMA10s         float64                            `json:"stat_rate_ewma_10s"`
+	RateEWMA60s         float64                            `json:"stat_rate_ewma_60s"`
+	By                  map[string]map[string]*LabeledStat `json:"-"`
 }
 
-type StatValue int
+// LabeledStat is the share of a Stat for a single label value, e.g. a single server or NAK reason.
+type LabeledStat struct {
+	Value               int       `json:"stat_value"`
+	PreviousTickerValue int       `json:"stat_previous_ticker_value"`
+	RatePerSecond       float64   `json:"stat_rate_per_second"`
+	RateEWMA1s          float64   `json:"stat_rate_ewma_1s"`
+	RateEWMA10s         float64   `json:"stat_rate_ewma_10s"`
+	RateEWMA60s         float64   `json:"stat_rate_ewma_60s"`
+	LastSeen            time.Time `json:"stat_last_seen"`
+}
+
+type GaugeStat struct {
+	Name  string                        `json:"stat_name"`
+	Type  string                        `json:"stat_type"`
+	Value float64                       `json:"stat_value"`
+	By    map[string]map[string]float64 `json:"-"`
+}
+
+type InfoStat struct {
+	Name  string `json:"stat_name"`
+	Type  string `json:"stat_type"`
+	Value string `json:"stat_value"`
+}
+
+type HistogramBucket struct {
+	UpperBound string `json:"le"`
+	Count      int    `json:"count"`
+}
+
+type HistogramStat struct {
+	Name    string            `json:"stat_name"`
+	Type    string            `json:"stat_type"`
+	Count   int               `json:"stat_count"`
+	Sum     float64           `json:"stat_sum"`
+	Buckets []HistogramBucket `json:"stat_buckets"`
+}
+
+// MarshalJSON adds each label breakdown as a stat_by_<label> object next to the usual fields.
+func (s Stat) MarshalJSON() ([]byte, error) {
+	type plainStat Stat
+
+	jsonData, err := json.Marshal(plainStat(s))
+	if err != nil || len(s.By) == 0 {
+		return jsonData, err
+	}
+
+	breakdowns := make(map[string]interface{}, len(s.By))
+	for label, breakdown := range s.By {
+		breakdowns[label] = breakdown
+	}
+
+	return appendBreakdowns(jsonData, breakdowns)
+}
+
+// MarshalJSON adds label breakdowns the same way as for counters.
+func (s GaugeStat) MarshalJSON() ([]byte, error) {
+	type plainGaugeStat GaugeStat
+
+	jsonData, err := json.Marshal(plainGaugeStat(s))
+	if err != nil || len(s.By) == 0 {
+		return jsonData, err
+	}
+
+	breakdowns := make(map[string]interface{}, len(s.By))
+	for label, breakdown := range s.By {
+		breakdowns[label] = breakdown
+	}
+
+	return appendBreakdowns(jsonData, breakdowns)
+}
+
+func appendBreakdowns(jsonData []byte, breakdowns map[string]interface{}) ([]byte, error) {
+
+	labels := make([]string, 0, len(breakdowns))
+	for label := range breakdowns {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	jsonData = jsonData[:len(jsonData)-1]
+
+	for _, label := range labels {
+		breakdown, err := json.Marshal(breakdowns[label])
+		if err != nil {
+			return nil, err
+		}
+
+		jsonData = append(jsonData, []byte(",\"stat_by_"+label+"\":")...)
+		jsonData = append(jsonData, breakdown...)
+	}
+
+	return append(jsonData, '}'), nil
+}
 
 type Stats interface {
-	AddStat(s StatValue) bool
+	Registry() *Registry
 	Init() error
 	Run()
 	String() string
+	History(since time.Time) string
+	Reset() error
 	Stop() error
 	DeInit() error
 }
@@ -3,6 +3,7 @@ package stats_test
 import (
 	"github.com/ipchama/dhammer/stats"
 	"testing"
+	"time"
 )
 
 type TestHammerConfig struct {
@@ -20,8 +21,8 @@ func (t *TestStats) Init() error {
 	return nil
 }
 
-func (t *TestStats) AddStat(s stats.StatValue) bool {
-	return true
+func (t *TestStats) Registry() *stats.Registry {
+	return stats.NewRegistry()
 }
 
 func (t *TestStats) Run() {
@@ -31,6 +32,14 @@ func (t *TestStats) String() string {
 	return ""
 }
 
+func (t *TestStats) History(since time.Time) string {
+	return ""
+}
+
+func (t *TestStats) Reset() error {
+	return nil
+}
+
 func (t *TestStats) Stop() error {
 	return nil
 }
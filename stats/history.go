@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is the full set of stats as of one stats tick.
+type HistoryEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Stats     json.RawMessage `json:"stats"`
+}
+
+// history is a bounded ring of per-tick snapshots.  Once full, each new entry replaces the oldest.
+type history struct {
+	mux     sync.RWMutex
+	entries []HistoryEntry
+	next    int
+	full    bool
+}
+
+// newHistory keeps size entries.  Anything below 1 keeps none.
+func newHistory(size int) *history {
+	if size < 0 {
+		size = 0
+	}
+
+	return &history{
+		entries: make([]HistoryEntry, size),
+	}
+}
+
+func (h *history) add(e HistoryEntry) {
+	if len(h.entries) == 0 {
+		return
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.entries[h.next] = e
+
+	if h.next++; h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// since returns entries newer than t, oldest first.
+func (h *history) since(t time.Time) []HistoryEntry {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+
+	entries := make([]HistoryEntry, 0)
+
+	start, count := 0, h.next
+	if h.full {
+		start, count = h.next, len(h.entries)
+	}
+
+	for i := 0; i < count; i++ {
+		e := h.entries[(start+i)%len(h.entries)]
+		if e.Timestamp.After(t) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
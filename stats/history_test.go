@@ -0,0 +1,42 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+
+	h := newHistory(3)
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		h.add(HistoryEntry{Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	entries := h.since(time.Time{})
+
+	if len(entries) != 3 {
+		t.Fatalf("Expected the history to be bounded to 3 entries, got %d.", len(entries))
+	}
+
+	for i, e := range entries {
+		if want := start.Add(time.Duration(i+2) * time.Second); !e.Timestamp.Equal(want) {
+			t.Errorf("Entry %d is out of order: %s, wanted %s.", i, e.Timestamp, want)
+		}
+	}
+
+	if entries = h.since(start.Add(3 * time.Second)); len(entries) != 1 {
+		t.Errorf("Expected 1 entry since the 4th tick, got %d.", len(entries))
+	}
+}
+
+func TestHistoryNegativeSize(t *testing.T) {
+
+	h := newHistory(-1)
+	h.add(HistoryEntry{Timestamp: time.Now()})
+
+	if entries := h.since(time.Time{}); len(entries) != 0 {
+		t.Errorf("Expected no history with a negative size, got %d entries.", len(entries))
+	}
+}
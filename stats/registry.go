@@ -0,0 +1,743 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	The registry is where generators and handlers declare their stats at Init time.
+	Declaring a name twice returns the existing stat, so a handler and generator can share one.
+	Stats are listed in the order they were declared.
+	Reset zeroes counters and histograms while holding the registry lock, so no tick, snapshot or export sees a half-reset registry.
+	Gauges describe current state, like the number of addresses bound, so they are left alone.  Whoever keeps a gauge
+	that only makes sense since the last reset, like the number of unique addresses offered, can clear it with OnReset.
+
+	A scoped registry is a view of another one for a single value of a label, e.g. one interface.  Stats declared
+	through it are the parent's, and everything counted or set through it is also broken down by that label value.
+	Gauges set through scopes add up across them, or average out for mean gauges like percentages.
+*/
+
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+	InfoType      = "info"
+)
+
+// SmoothingWindows are the windows of the exponentially weighted moving average rates kept next to each counter's instantaneous rate, load-average style.
+var SmoothingWindows = [3]time.Duration{time.Second, 10 * time.Second, 60 * time.Second}
+
+// Sample is a single flattened value of a stat, as used for logging and exports.
+type Sample struct {
+	Name          string
+	Type          string
+	Labels        map[string]string
+	Value         float64
+	RatePerSecond float64
+	SmoothedRates [len(SmoothingWindows)]float64
+}
+
+type Metric interface {
+	Name() string
+	Samples() []Sample
+	tick(seconds float64)
+	snapshot() interface{}
+	reset()
+}
+
+type Registry struct {
+	mux     sync.RWMutex
+	metrics []Metric
+	names   map[string]Metric
+	onReset []func()
+
+	parent     *Registry
+	scopeLabel string
+	scopeValue string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]Metric),
+	}
+}
+
+// Scoped gives a view of the registry for the label value.
+func (r *Registry) Scoped(label string, value string) *Registry {
+	return &Registry{
+		parent:     r,
+		scopeLabel: label,
+		scopeValue: value,
+	}
+}
+
+func (r *Registry) declare(name string, create func() Metric) Metric {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if m, found := r.names[name]; found {
+		return m
+	}
+
+	m := create()
+	r.names[name] = m
+	r.metrics = append(r.metrics, m)
+
+	return m
+}
+
+// Counter declares a counter or returns the one already declared with that name.
+func (r *Registry) Counter(name string) *Counter {
+	if r.parent != nil {
+		return &Counter{name: name, scope: r.parent.Counter(name), scopeLabel: r.scopeLabel, scopeValue: r.scopeValue}
+	}
+
+	return r.declare(name, func() Metric { return newCounter(name) }).(*Counter)
+}
+
+// Gauge declares a gauge or returns the one already declared with that name.
+func (r *Registry) Gauge(name string) *Gauge {
+	if r.parent != nil {
+		return &Gauge{name: name, scope: r.parent.Gauge(name), scopeLabel: r.scopeLabel, scopeValue: r.scopeValue}
+	}
+
+	return r.declare(name, func() Metric { return newGauge(name, false) }).(*Gauge)
+}
+
+// MeanGauge is a gauge that averages across scopes rather than adding up.
+func (r *Registry) MeanGauge(name string) *Gauge {
+	if r.parent != nil {
+		return &Gauge{name: name, scope: r.parent.MeanGauge(name), scopeLabel: r.scopeLabel, scopeValue: r.scopeValue}
+	}
+
+	return r.declare(name, func() Metric { return newGauge(name, true) }).(*Gauge)
+}
+
+// Histogram declares a histogram with the given upper bucket bounds or returns the one already declared with that name.
+// Histograms aren't broken down by scope.
+func (r *Registry) Histogram(name string, bounds []float64) *Histogram {
+	if r.parent != nil {
+		return r.parent.Histogram(name, bounds)
+	}
+
+	return r.declare(name, func() Metric { return newHistogram(name, bounds) }).(*Histogram)
+}
+
+// Info declares a text stat, or returns the one already declared with that name.  Info stats aren't broken down by scope.
+func (r *Registry) Info(name string, label string) *Info {
+	if r.parent != nil {
+		return r.parent.Info(name, label)
+	}
+
+	return r.declare(name, func() Metric { return &Info{name: name, label: label} }).(*Info)
+}
+
+func (r *Registry) Metrics() []Metric {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	metrics := make([]Metric, len(r.metrics))
+	copy(metrics, r.metrics)
+
+	return metrics
+}
+
+func (r *Registry) Samples() []Sample {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	samples := make([]Sample, 0)
+
+	for _, m := range r.metrics {
+		samples = append(samples, m.Samples()...)
+	}
+
+	return samples
+}
+
+// Tick recalculates rates given the number of seconds since the previous tick.
+func (r *Registry) Tick(seconds float64) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	for _, m := range r.metrics {
+		m.tick(seconds)
+	}
+}
+
+func (r *Registry) Reset() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, m := range r.metrics {
+		m.reset()
+	}
+
+	for _, f := range r.onReset {
+		f()
+	}
+}
+
+// OnReset has f called on every Reset, with the registry locked, so it mustn't declare stats.
+func (r *Registry) OnReset(f func()) {
+	if r.parent != nil {
+		r.parent.OnReset(f)
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.onReset = append(r.onReset, f)
+}
+
+func (r *Registry) MarshalJSON() ([]byte, error) {
+	r.mux.RLock()
+	snapshots := make([]interface{}, len(r.metrics))
+
+	for i, m := range r.metrics {
+		snapshots[i] = m.snapshot()
+	}
+	r.mux.RUnlock()
+
+	return json.Marshal(snapshots)
+}
+
+/*************************
+ * Counter
+ *************************/
+
+type Counter struct {
+	value int64 // First for 64-bit alignment of atomic operations.
+	name  string
+
+	mux      sync.Mutex
+	previous int64
+	rate     float64
+	smoothed [len(SmoothingWindows)]float64
+	ticked   bool
+	lastSeen time.Time
+
+	labelNames []string
+	children   map[string]map[string]*Counter
+
+	// Counters from a scoped registry count against the parent registry's counter and its share for the scope.
+	scope      *Counter
+	scopeLabel string
+	scopeValue string
+}
+
+func newCounter(name string) *Counter {
+	return &Counter{
+		name:     name,
+		children: make(map[string]map[string]*Counter),
+	}
+}
+
+func (c *Counter) Name() string {
+	return c.name
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int) {
+	if c.scope != nil {
+		c.scope.Add(n)
+		c.scope.addBy(c.scopeLabel, c.scopeValue, n)
+		return
+	}
+
+	atomic.AddInt64(&c.value, int64(n))
+}
+
+// Value is the counter's total, or its share for the scope.
+func (c *Counter) Value() int {
+	if c.scope != nil {
+		return c.scope.valueBy(c.scopeLabel, c.scopeValue)
+	}
+
+	return int(atomic.LoadInt64(&c.value))
+}
+
+/*
+IncBy counts against the label value's share of the counter.  It does not increment the counter itself.
+Label values keep their own rates and the last time they were seen, so a peer that quietly stopped answering
+keeps its last value, drops to a zero rate, and has a stale last-seen time.
+*/
+func (c *Counter) IncBy(label string, value string) {
+	if c.scope != nil { // Breakdowns are only kept for the whole counter.
+		c.scope.IncBy(label, value)
+		return
+	}
+
+	c.addBy(label, value, 1)
+}
+
+func (c *Counter) addBy(label string, value string, n int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	values, found := c.children[label]
+	if !found {
+		values = make(map[string]*Counter)
+		c.children[label] = values
+		c.labelNames = append(c.labelNames, label)
+	}
+
+	child, found := values[value]
+	if !found {
+		child = &Counter{name: c.name}
+		values[value] = child
+	}
+
+	child.value += int64(n)
+	child.lastSeen = time.Now()
+}
+
+func (c *Counter) valueBy(label string, value string) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if child, found := c.children[label][value]; found {
+		return int(child.value)
+	}
+
+	return 0
+}
+
+func (c *Counter) tick(seconds float64) {
+	value := atomic.LoadInt64(&c.value)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.calculateRates(value, seconds)
+
+	for _, values := range c.children {
+		for _, child := range values {
+			child.calculateRates(child.value, seconds)
+		}
+	}
+}
+
+/*
+Each smoothed rate moves toward the instantaneous rate by 1 - e^(-tick/window), like the kernel's load averages.
+This keeps them independent of the tick interval.  They start at the first instantaneous rate rather than at 0 so short runs aren't dragged down.
+*/
+func (c *Counter) calculateRates(value int64, seconds float64) {
+	if seconds <= 0 {
+		return
+	}
+
+	c.rate = float64(value-c.previous) / seconds
+	c.previous = value
+
+	for i, w := range SmoothingWindows {
+		if !c.ticked {
+			c.smoothed[i] = c.rate
+			continue
+		}
+
+		alpha := 1 - math.Exp(-seconds/w.Seconds())
+		c.smoothed[i] += alpha * (c.rate - c.smoothed[i])
+	}
+
+	c.ticked = true
+}
+
+func (c *Counter) Samples() []Sample {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	samples := []Sample{{Name: c.name, Type: CounterType, Value: float64(atomic.LoadInt64(&c.value)), RatePerSecond: c.rate, SmoothedRates: c.smoothed}}
+
+	for _, label := range c.labelNames {
+		for _, value := range sortedKeys(c.children[label]) {
+			child := c.children[label][value]
+			samples = append(samples, Sample{
+				Name:          c.name,
+				Type:          CounterType,
+				Labels:        map[string]string{label: value},
+				Value:         float64(child.value),
+				RatePerSecond: child.rate,
+				SmoothedRates: child.smoothed,
+			})
+		}
+	}
+
+	return samples
+}
+
+func (c *Counter) snapshot() interface{} {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	s := Stat{
+		Name:                c.name,
+		Value:               int(atomic.LoadInt64(&c.value)),
+		PreviousTickerValue: int(c.previous),
+		RatePerSecond:       c.rate,
+		RateEWMA1s:          c.smoothed[0],
+		RateEWMA10s:         c.smoothed[1],
+		RateEWMA60s:         c.smoothed[2],
+	}
+
+	if len(c.labelNames) > 0 {
+		s.By = make(map[string]map[string]*LabeledStat)
+	}
+
+	for _, label := range c.labelNames {
+		s.By[label] = make(map[string]*LabeledStat)
+		for value, child := range c.children[label] {
+			s.By[label][value] = &LabeledStat{
+				Value:               int(child.value),
+				PreviousTickerValue: int(child.previous),
+				RatePerSecond:       child.rate,
+				RateEWMA1s:          child.smoothed[0],
+				RateEWMA10s:         child.smoothed[1],
+				RateEWMA60s:         child.smoothed[2],
+				LastSeen:            child.lastSeen,
+			}
+		}
+	}
+
+	return s
+}
+
+func (c *Counter) reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	atomic.StoreInt64(&c.value, 0)
+
+	c.previous = 0
+	c.rate = 0
+	c.smoothed = [len(SmoothingWindows)]float64{}
+	c.ticked = false
+	c.labelNames = nil
+	c.children = make(map[string]map[string]*Counter)
+}
+
+func sortedKeys(m map[string]*Counter) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*************************
+ * Gauge
+ *************************/
+
+type Gauge struct {
+	bits uint64
+	name string
+	mean bool // Average across label values instead of adding them up.
+
+	mux        sync.Mutex
+	labelNames []string
+	children   map[string]map[string]float64
+
+	// Gauges from a scoped registry set the parent registry's gauge for the scope.
+	scope      *Gauge
+	scopeLabel string
+	scopeValue string
+}
+
+func newGauge(name string, mean bool) *Gauge {
+	return &Gauge{
+		name:     name,
+		mean:     mean,
+		children: make(map[string]map[string]float64),
+	}
+}
+
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+func (g *Gauge) Set(v float64) {
+	if g.scope != nil {
+		g.scope.setBy(g.scopeLabel, g.scopeValue, func(float64) float64 { return v })
+		return
+	}
+
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	if g.scope != nil {
+		g.scope.setBy(g.scopeLabel, g.scopeValue, func(old float64) float64 { return old + delta })
+		return
+	}
+
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		if atomic.CompareAndSwapUint64(&g.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Value is the gauge's value, or its value for the scope.
+func (g *Gauge) Value() float64 {
+	if g.scope != nil {
+		g.scope.mux.Lock()
+		defer g.scope.mux.Unlock()
+
+		return g.scope.children[g.scopeLabel][g.scopeValue]
+	}
+
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// setBy updates the label value's share and recalculates the whole gauge from the label's values.
+func (g *Gauge) setBy(label string, value string, update func(float64) float64) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	values, found := g.children[label]
+	if !found {
+		values = make(map[string]float64)
+		g.children[label] = values
+		g.labelNames = append(g.labelNames, label)
+	}
+
+	values[value] = update(values[value])
+
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+
+	if g.mean {
+		total /= float64(len(values))
+	}
+
+	atomic.StoreUint64(&g.bits, math.Float64bits(total))
+}
+
+func (g *Gauge) tick(seconds float64) {
+}
+
+func (g *Gauge) reset() {
+}
+
+func (g *Gauge) Samples() []Sample {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	samples := []Sample{{Name: g.name, Type: GaugeType, Value: g.Value()}}
+
+	for _, label := range g.labelNames {
+		values := g.children[label]
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, value := range keys {
+			samples = append(samples, Sample{Name: g.name, Type: GaugeType, Labels: map[string]string{label: value}, Value: values[value]})
+		}
+	}
+
+	return samples
+}
+
+func (g *Gauge) snapshot() interface{} {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	s := GaugeStat{
+		Name:  g.name,
+		Type:  GaugeType,
+		Value: g.Value(),
+	}
+
+	if len(g.labelNames) > 0 {
+		s.By = make(map[string]map[string]float64)
+	}
+
+	for _, label := range g.labelNames {
+		s.By[label] = make(map[string]float64)
+		for value, v := range g.children[label] {
+			s.By[label][value] = v
+		}
+	}
+
+	return s
+}
+
+/*************************
+ * Histogram
+ *************************/
+
+type Histogram struct {
+	name string
+
+	mux    sync.Mutex
+	bounds []float64
+	counts []int // One more than bounds for anything over the last bound.
+	count  int
+	sum    float64
+}
+
+func newHistogram(name string, bounds []float64) *Histogram {
+	b := make([]float64, len(bounds))
+	copy(b, bounds)
+	sort.Float64s(b)
+
+	return &Histogram{
+		name:   name,
+		bounds: b,
+		counts: make([]int, len(b)+1),
+	}
+}
+
+func (h *Histogram) Name() string {
+	return h.name
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mux.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.mux.Unlock()
+}
+
+func (h *Histogram) tick(seconds float64) {
+}
+
+func (h *Histogram) reset() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.counts = make([]int, len(h.bounds)+1)
+	h.count = 0
+	h.sum = 0
+}
+
+func (h *Histogram) Samples() []Sample {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	samples := []Sample{
+		{Name: h.name + "_count", Type: HistogramType, Value: float64(h.count)},
+		{Name: h.name + "_sum", Type: HistogramType, Value: h.sum},
+	}
+
+	for i, b := range h.buckets() {
+		samples = append(samples, Sample{Name: h.name + "_bucket", Type: HistogramType, Labels: map[string]string{"le": b.UpperBound}, Value: float64(h.cumulative(i))})
+	}
+
+	return samples
+}
+
+func (h *Histogram) snapshot() interface{} {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	return HistogramStat{
+		Name:    h.name,
+		Type:    HistogramType,
+		Count:   h.count,
+		Sum:     h.sum,
+		Buckets: h.buckets(),
+	}
+}
+
+// Must be called with the lock held.
+func (h *Histogram) buckets() []HistogramBucket {
+	buckets := make([]HistogramBucket, len(h.counts))
+
+	for i := range h.counts {
+		bound := "+Inf"
+		if i < len(h.bounds) {
+			bound = formatBound(h.bounds[i])
+		}
+		buckets[i] = HistogramBucket{UpperBound: bound, Count: h.counts[i]}
+	}
+
+	return buckets
+}
+
+// Must be called with the lock held.
+func (h *Histogram) cumulative(i int) int {
+	total := 0
+	for j := 0; j <= i; j++ {
+		total += h.counts[j]
+	}
+	return total
+}
+
+/*************************
+ * Info
+ *************************/
+
+// Info is a stat whose value is text, like the current load profile phase.  Exports get it the way Prometheus does
+// info metrics, as a sample of 1 with the text under its label.
+type Info struct {
+	name  string
+	label string
+
+	mux   sync.Mutex
+	value string
+}
+
+func (i *Info) Name() string {
+	return i.name
+}
+
+func (i *Info) Set(v string) {
+	i.mux.Lock()
+	i.value = v
+	i.mux.Unlock()
+}
+
+func (i *Info) Value() string {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	return i.value
+}
+
+func (i *Info) tick(seconds float64) {
+}
+
+func (i *Info) reset() {
+}
+
+func (i *Info) Samples() []Sample {
+	return []Sample{{Name: i.name, Type: InfoType, Labels: map[string]string{i.label: i.Value()}, Value: 1}}
+}
+
+func (i *Info) snapshot() interface{} {
+	return InfoStat{
+		Name:  i.name,
+		Type:  InfoType,
+		Value: i.Value(),
+	}
+}
+
+// smoothingWindowName gives the window as whole seconds, e.g. 60s rather than 1m0s.
+func smoothingWindowName(w time.Duration) string {
+	return strconv.Itoa(int(w.Seconds())) + "s"
+}
+
+func formatBound(b float64) string {
+	return strconv.FormatFloat(b, 'g', -1, 64)
+}
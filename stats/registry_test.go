@@ -0,0 +1,217 @@
+package stats_test
+
+import (
+	"encoding/json"
+	"github.com/ipchama/dhammer/stats"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+
+	r := stats.NewRegistry()
+
+	offers := r.Counter("OfferReceived")
+	r.Counter("AckReceived")
+	r.Gauge("AddressesOffered").Set(2)
+	r.Histogram("BatchSize", []float64{1, 8, 64}).Observe(5)
+
+	if r.Counter("OfferReceived") != offers {
+		t.Errorf("Registry declared the same counter twice.")
+	}
+
+	offers.Inc()
+	offers.Inc()
+	offers.IncBy("server_id", "10.0.0.1")
+
+	r.Tick(2)
+
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshots []map[string]interface{}
+	if err = json.Unmarshal(jsonData, &snapshots); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 4 {
+		t.Fatalf("Expected 4 stats, got %d.", len(snapshots))
+	}
+
+	offerStat := snapshots[0]
+
+	for _, field := range []string{"stat_name", "stat_value", "stat_previous_ticker_value", "stat_rate_per_second"} {
+		if _, found := offerStat[field]; !found {
+			t.Errorf("Counter is missing field %s.", field)
+		}
+	}
+
+	if offerStat["stat_name"] != "OfferReceived" || offerStat["stat_value"].(float64) != 2 || offerStat["stat_rate_per_second"].(float64) != 1 {
+		t.Errorf("Unexpected counter snapshot: %v", offerStat)
+	}
+
+	if byServer, ok := offerStat["stat_by_server_id"].(map[string]interface{}); !ok || byServer["10.0.0.1"] == nil {
+		t.Errorf("Counter is missing its server_id breakdown: %v", offerStat)
+	}
+
+	if snapshots[1]["stat_name"] != "AckReceived" {
+		t.Errorf("Stats are not in declaration order.")
+	}
+
+	if snapshots[2]["stat_type"] != stats.GaugeType || snapshots[2]["stat_value"].(float64) != 2 {
+		t.Errorf("Unexpected gauge snapshot: %v", snapshots[2])
+	}
+
+	if snapshots[3]["stat_type"] != stats.HistogramType || snapshots[3]["stat_count"].(float64) != 1 {
+		t.Errorf("Unexpected histogram snapshot: %v", snapshots[3])
+	}
+}
+
+func TestCounterSmoothedRates(t *testing.T) {
+
+	r := stats.NewRegistry()
+	c := r.Counter("DiscoverSent")
+
+	// 100/s for a while, then nothing.  The 1s average should fall much faster than the 60s one.
+	for i := 0; i < 10; i++ {
+		c.Add(10)
+		r.Tick(0.1)
+	}
+
+	r.Tick(1)
+
+	s := r.Samples()[0]
+
+	if s.RatePerSecond != 0 {
+		t.Errorf("Expected an instantaneous rate of 0, got %f.", s.RatePerSecond)
+	}
+
+	if !(s.SmoothedRates[0] < s.SmoothedRates[1] && s.SmoothedRates[1] < s.SmoothedRates[2] && s.SmoothedRates[2] < 100) {
+		t.Errorf("Smoothed rates did not decay by window: %v", s.SmoothedRates)
+	}
+
+	if s.SmoothedRates[2] < 95 {
+		t.Errorf("60s smoothed rate decayed too quickly: %f", s.SmoothedRates[2])
+	}
+}
+
+func TestRegistryReset(t *testing.T) {
+
+	r := stats.NewRegistry()
+	c := r.Counter("AckReceived")
+	g := r.Gauge("AddressesBound")
+
+	c.Add(5)
+	c.IncBy("server_id", "10.0.0.1")
+	g.Set(3)
+	r.Tick(1)
+
+	offered := r.Scoped("interface", "eth0").Gauge("AddressesOffered")
+	offered.Set(7)
+	r.Scoped("interface", "eth0").OnReset(func() { offered.Set(0) })
+
+	r.Reset()
+
+	if v := r.Gauge("AddressesOffered").Value(); v != 0 {
+		t.Errorf("OnReset did not clear the gauge, got %f.", v)
+	}
+
+	s := r.Samples()
+
+	if len(s) != 4 || s[0].Value != 0 || s[0].RatePerSecond != 0 {
+		t.Errorf("Counter was not reset: %v", s)
+	}
+
+	if s[1].Value != 3 {
+		t.Errorf("Gauge should not be reset, got %f.", s[1].Value)
+	}
+}
+
+func TestRegistryScoped(t *testing.T) {
+
+	r := stats.NewRegistry()
+	eth0 := r.Scoped("interface", "eth0")
+	eth1 := r.Scoped("interface", "eth1")
+
+	eth0.Counter("DiscoverSent").Add(3)
+	eth1.Counter("DiscoverSent").Inc()
+	eth1.Counter("DiscoverSent").IncBy("vlan", "5")
+
+	eth0.Gauge("ClientsBound").Set(10)
+	eth1.Gauge("ClientsBound").Set(5)
+	eth1.Gauge("ClientsBound").Add(1)
+
+	eth0.MeanGauge("PacingError").Set(-2)
+	eth1.MeanGauge("PacingError").Set(4)
+
+	if v := r.Counter("DiscoverSent").Value(); v != 4 {
+		t.Errorf("Scoped counters add up to %d, expected 4.", v)
+	}
+
+	if v := eth0.Counter("DiscoverSent").Value(); v != 3 {
+		t.Errorf("eth0's share is %d, expected 3.", v)
+	}
+
+	if v := r.Gauge("ClientsBound").Value(); v != 16 {
+		t.Errorf("Scoped gauges add up to %f, expected 16.", v)
+	}
+
+	if v := eth1.Gauge("ClientsBound").Value(); v != 6 {
+		t.Errorf("eth1's gauge is %f, expected 6.", v)
+	}
+
+	if v := r.Gauge("PacingError").Value(); v != 1 {
+		t.Errorf("Mean gauge is %f, expected 1.", v)
+	}
+
+	found := 0
+	for _, s := range r.Samples() {
+		if s.Labels["interface"] == "eth1" && (s.Name == "DiscoverSent" && s.Value == 1 || s.Name == "ClientsBound" && s.Value == 6) {
+			found++
+		}
+	}
+
+	if found != 2 {
+		t.Errorf("Per-interface samples are missing: %v", r.Samples())
+	}
+
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshots []map[string]interface{}
+	if err = json.Unmarshal(jsonData, &snapshots); err != nil {
+		t.Fatal(err)
+	}
+
+	if byInterface, ok := snapshots[1]["stat_by_interface"].(map[string]interface{}); !ok || byInterface["eth0"].(float64) != 10 {
+		t.Errorf("Gauge is missing its interface breakdown: %v", snapshots[1])
+	}
+}
+
+func TestRegistryInfo(t *testing.T) {
+
+	r := stats.NewRegistry()
+
+	r.Scoped("interface", "eth0").Info("ProfilePhase", "phase").Set("warmup")
+
+	if v := r.Info("ProfilePhase", "phase").Value(); v != "warmup" {
+		t.Errorf("Info is %q, expected warmup.", v)
+	}
+
+	samples := r.Samples()
+	if len(samples) != 1 || samples[0].Labels["phase"] != "warmup" || samples[0].Value != 1 {
+		t.Errorf("Unexpected info samples: %v", samples)
+	}
+
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(jsonData) != `[{"stat_name":"ProfilePhase","stat_type":"info","stat_value":"warmup"}]` {
+		t.Errorf("Unexpected info JSON: %s", jsonData)
+	}
+}
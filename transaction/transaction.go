@@ -0,0 +1,107 @@
+package transaction
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	In closed-loop mode the generator only starts a client's next transaction once its last one is over, so it has to
+	hear back from the handler.  The generator starts a transaction under its xid, and the handler finishes it when the
+	reply that ends it comes in (or when it sends the DECLINE that ends it).  Transactions that never finish are expired
+	after the timeout, so a lost reply doesn't take a client out for good.
+
+	A nil Tracker tracks nothing, which is what the handler gets in open-loop mode.
+*/
+
+type Result struct {
+	Outcome  string // ack, nak, offer or decline.
+	Duration time.Duration
+}
+
+type Tracker struct {
+	mux      sync.Mutex
+	timeout  time.Duration
+	inFlight map[uint32]time.Time
+	finished chan Result
+}
+
+// NewTracker makes a tracker for up to clients transactions in flight at once.
+func NewTracker(clients int, timeout time.Duration) *Tracker {
+	return &Tracker{
+		timeout:  timeout,
+		inFlight: make(map[uint32]time.Time, clients),
+		finished: make(chan Result, clients), // Never more finished than were in flight, so Finish never blocks.
+	}
+}
+
+func (t *Tracker) Start(xid uint32, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mux.Lock()
+	t.inFlight[xid] = now
+	t.mux.Unlock()
+}
+
+// Abandon forgets a transaction that never got going, e.g. because its DISCOVER couldn't be queued.
+func (t *Tracker) Abandon(xid uint32) {
+	if t == nil {
+		return
+	}
+
+	t.mux.Lock()
+	delete(t.inFlight, xid)
+	t.mux.Unlock()
+}
+
+// Finish ends a transaction.  Anything for an xid that isn't in flight, like a second server's OFFER, is ignored.
+func (t *Tracker) Finish(xid uint32, outcome string, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mux.Lock()
+	started, found := t.inFlight[xid]
+	delete(t.inFlight, xid)
+	t.mux.Unlock()
+
+	if !found {
+		return
+	}
+
+	select {
+	case t.finished <- Result{Outcome: outcome, Duration: now.Sub(started)}:
+	default:
+	}
+}
+
+func (t *Tracker) Finished() <-chan Result {
+	return t.finished
+}
+
+// Expire gives up on transactions that have been in flight longer than the timeout and says how many there were.
+func (t *Tracker) Expire(now time.Time) int {
+
+	expired := 0
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for xid, started := range t.inFlight {
+		if now.Sub(started) > t.timeout {
+			delete(t.inFlight, xid)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+func (t *Tracker) InFlight() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return len(t.inFlight)
+}
@@ -0,0 +1,47 @@
+package transaction
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+
+	now := time.Unix(0, 0)
+	tr := NewTracker(3, time.Second)
+
+	tr.Start(1, now)
+	tr.Start(2, now)
+	tr.Start(3, now)
+	tr.Abandon(3)
+
+	tr.Finish(1, "ack", now.Add(20*time.Millisecond))
+	tr.Finish(1, "ack", now.Add(30*time.Millisecond)) // A second reply for the same transaction.
+
+	select {
+	case r := <-tr.Finished():
+		if r.Outcome != "ack" || r.Duration != 20*time.Millisecond {
+			t.Errorf("Unexpected result %v", r)
+		}
+	default:
+		t.Fatal("Finished transaction wasn't reported")
+	}
+
+	select {
+	case r := <-tr.Finished():
+		t.Errorf("Transaction reported twice: %v", r)
+	default:
+	}
+
+	if n := tr.Expire(now.Add(time.Second)); n != 0 {
+		t.Errorf("Expired %d transactions before the timeout", n)
+	}
+
+	if n := tr.Expire(now.Add(2 * time.Second)); n != 1 || tr.InFlight() != 0 {
+		t.Errorf("Expired %d transactions, %d still in flight", n, tr.InFlight())
+	}
+
+	var nilTracker *Tracker
+	nilTracker.Start(4, now)
+	nilTracker.Finish(4, "ack", now)
+}
@@ -0,0 +1,231 @@
+package vlan
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Clients can be spread across VLANs, either a single 802.1Q tag (C-VLAN) or an 802.1ad S-VLAN with an 802.1Q C-VLAN
+	inside it.  A Plan hands each client MAC the next stack in S-VLAN x C-VLAN order, C-VLAN first, the first time it's
+	asked, so the generator and the handler agree on a client's tags without anything else being shared.
+*/
+
+const (
+	MinID = 1
+	MaxID = 4094
+)
+
+type Tag struct {
+	TPID layers.EthernetType
+	ID   uint16
+}
+
+// Stack is a client's tags, outermost first.
+type Stack []Tag
+
+type Plan struct {
+	sTPID  layers.EthernetType
+	sVlans []uint16
+	cVlans []uint16
+
+	mux      sync.RWMutex
+	assigned map[string]Stack
+	next     int
+}
+
+// ParseRanges parses a list of VLAN IDs and ranges, e.g. "1-4000" or "10,20,30-39".
+func ParseRanges(s string) ([]uint16, error) {
+
+	ids := make([]uint16, 0)
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.New("Bad VLAN ID: " + part)
+		}
+
+		last := first
+
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, errors.New("Bad VLAN range: " + part)
+			}
+		}
+
+		if first < MinID || last > MaxID || first > last {
+			return nil, errors.New("VLAN range must be within 1-4094: " + part)
+		}
+
+		for id := first; id <= last; id++ {
+			ids = append(ids, uint16(id))
+		}
+	}
+
+	return ids, nil
+}
+
+// NewPlan returns a plan for single-tagged clients if sVlans is empty, and double-tagged clients otherwise.
+func NewPlan(sTPID layers.EthernetType, sVlans []uint16, cVlans []uint16) (*Plan, error) {
+
+	if len(cVlans) == 0 {
+		return nil, errors.New("At least one C-VLAN is needed")
+	}
+
+	return &Plan{
+		sTPID:    sTPID,
+		sVlans:   sVlans,
+		cVlans:   cVlans,
+		assigned: make(map[string]Stack),
+	}, nil
+}
+
+// Depth is the number of tags each client gets.
+func (p *Plan) Depth() int {
+	if len(p.sVlans) > 0 {
+		return 2
+	}
+	return 1
+}
+
+func (p *Plan) stack(i int) Stack {
+
+	c := Tag{TPID: layers.EthernetTypeDot1Q, ID: p.cVlans[i%len(p.cVlans)]}
+
+	if len(p.sVlans) == 0 {
+		return Stack{c}
+	}
+
+	return Stack{{TPID: p.sTPID, ID: p.sVlans[(i/len(p.cVlans))%len(p.sVlans)]}, c}
+}
+
+// Assign gives the client its stack, picking the next one if it doesn't have one yet.
+func (p *Plan) Assign(mac net.HardwareAddr) Stack {
+	key := string(mac)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if s, found := p.assigned[key]; found {
+		return s
+	}
+
+	s := p.stack(p.next)
+	p.assigned[key] = s
+	p.next++
+
+	return s
+}
+
+// Lookup gives the stack already assigned to the client.
+func (p *Plan) Lookup(mac net.HardwareAddr) (Stack, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	s, found := p.assigned[string(mac)]
+	return s, found
+}
+
+// Placeholder gives a stack of depth 802.1Q tags, for building templates that get the real tags patched in later.
+func Placeholder(depth int) Stack {
+	s := make(Stack, depth)
+
+	for i := range s {
+		s[i].TPID = layers.EthernetTypeDot1Q
+	}
+
+	return s
+}
+
+// String gives the stack the way Linux names VLAN sub-interfaces, e.g. 100.5 for S-VLAN 100, C-VLAN 5.
+func (s Stack) String() string {
+	ids := make([]string, len(s))
+
+	for i, t := range s {
+		ids[i] = strconv.Itoa(int(t.ID))
+	}
+
+	return strings.Join(ids, ".")
+}
+
+func (s Stack) Equal(o Stack) bool {
+	if len(s) != len(o) {
+		return false
+	}
+
+	for i := range s {
+		if s[i].ID != o[i].ID {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Wrap returns eth, the stack's tags and then l, ready for serializing.  eth's type is set to the outer TPID, and inner is the type of what follows the tags.
+func (s Stack) Wrap(eth *layers.Ethernet, inner layers.EthernetType, l ...gopacket.SerializableLayer) []gopacket.SerializableLayer {
+
+	all := make([]gopacket.SerializableLayer, 0, 1+len(s)+len(l))
+	all = append(all, eth)
+
+	if len(s) == 0 {
+		eth.EthernetType = inner
+		return append(all, l...)
+	}
+
+	eth.EthernetType = s[0].TPID
+
+	for i, t := range s {
+		tag := &layers.Dot1Q{VLANIdentifier: t.ID, Type: inner}
+		if i < len(s)-1 {
+			tag.Type = s[i+1].TPID
+		}
+		all = append(all, tag)
+	}
+
+	return append(all, l...)
+}
+
+// FromPacket gives the tags a received frame carried, outermost first.
+func FromPacket(p gopacket.Packet) Stack {
+
+	var s Stack
+	var tpid layers.EthernetType
+
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.Ethernet:
+			tpid = l.EthernetType
+		case *layers.Dot1Q:
+			s = append(s, Tag{TPID: tpid, ID: l.VLANIdentifier})
+			tpid = l.Type
+		}
+	}
+
+	return s
+}
+
+// AppendTagged appends the frame to dst with a tag the kernel stripped off put back in front of the frame's own tags.
+// A zero TPID means 802.1Q.
+func AppendTagged(dst []byte, frame []byte, tpid uint16, tci uint16) []byte {
+
+	if len(frame) < 12 {
+		return append(dst, frame...)
+	}
+
+	if tpid == 0 {
+		tpid = uint16(layers.EthernetTypeDot1Q)
+	}
+
+	dst = append(dst, frame[:12]...)
+	dst = append(dst, byte(tpid>>8), byte(tpid), byte(tci>>8), byte(tci))
+
+	return append(dst, frame[12:]...)
+}
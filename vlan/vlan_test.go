@@ -0,0 +1,86 @@
+package vlan
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseRanges(t *testing.T) {
+	ids, err := ParseRanges("10, 20,30-32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ids, []uint16{10, 20, 30, 31, 32}) {
+		t.Errorf("Unexpected IDs: %v", ids)
+	}
+
+	for _, bad := range []string{"", "0", "4095", "5-4", "a-b", "1-"} {
+		if _, err := ParseRanges(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	p, err := NewPlan(layers.EthernetTypeQinQ, []uint16{100, 200}, []uint16{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"100.1", "100.2", "100.3", "200.1", "200.2", "200.3", "100.1"}
+
+	for i, name := range expected {
+		mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i)}
+
+		if s := p.Assign(mac); s.String() != name {
+			t.Errorf("Client %d got %s, expected %s", i, s, name)
+		}
+
+		if s, found := p.Lookup(mac); !found || s.String() != name {
+			t.Errorf("Client %d looked up as %s, expected %s", i, s, name)
+		}
+	}
+
+	// Same client, same tags.
+	if s := p.Assign(net.HardwareAddr{0, 0, 0, 0, 0, 1}); s.String() != "100.2" {
+		t.Errorf("Reassigned client got %s", s)
+	}
+
+	if _, found := p.Lookup(net.HardwareAddr{1, 1, 1, 1, 1, 1}); found {
+		t.Error("Found a client that was never assigned")
+	}
+}
+
+func TestWrapAndFromPacket(t *testing.T) {
+	s := Stack{{TPID: layers.EthernetTypeQinQ, ID: 100}, {TPID: layers.EthernetTypeDot1Q, ID: 5}}
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: layers.EthernetBroadcast}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(0, 0, 0, 0), DstIP: net.IPv4(255, 255, 255, 255)}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, s.Wrap(eth, layers.EthernetTypeIPv4, ip)...); err != nil {
+		t.Fatal(err)
+	}
+
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+
+	if got := FromPacket(p); !reflect.DeepEqual(got, s) {
+		t.Errorf("Got %v back, expected %v", got, s)
+	}
+
+	if p.Layer(layers.LayerTypeIPv4) == nil {
+		t.Error("No IPv4 layer inside the tags")
+	}
+
+	// As if the kernel had stripped the outer tag.
+	stripped := append(append([]byte{}, buf.Bytes()[:12]...), buf.Bytes()[16:]...)
+	p = gopacket.NewPacket(AppendTagged(nil, stripped, uint16(layers.EthernetTypeQinQ), 100), layers.LayerTypeEthernet, gopacket.Default)
+
+	if got := FromPacket(p); !reflect.DeepEqual(got, s) {
+		t.Errorf("Got %v back after putting the outer tag back, expected %v", got, s)
+	}
+}